@@ -0,0 +1,259 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// AdminOptions represents a struct for specifying configuration options for the admin endpoints.
+type AdminOptions struct {
+	// Auth authorizes requests to the endpoints. Default allows requests from loopback addresses only.
+	Auth func(*macaron.Context) bool
+	// Cache options shown by the config endpoint, typically the ones given to Cacher.
+	// Passwords in the adapter configuration are masked.
+	Options Options
+}
+
+func prepareAdminOptions(options []AdminOptions) AdminOptions {
+	var opt AdminOptions
+	if len(options) > 0 {
+		opt = options[0]
+	}
+	if opt.Auth == nil {
+		opt.Auth = isLoopback
+	}
+	if opt.Options.Clock == nil {
+		opt.Options.Clock = DefaultClock
+	}
+	return opt
+}
+
+// isLoopback returns true if the request comes from a loopback address,
+// proxy headers are ignored.
+func isLoopback(ctx *macaron.Context) bool {
+	host, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		host = ctx.Req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+var (
+	passwordPattern = regexp.MustCompile(`(password=)[^,;\s]*`)
+	userinfoPattern = regexp.MustCompile(`((?:^|://)[^:@/\s]*):[^@/\s]*@`)
+)
+
+// maskConfig masks passwords in adapter configuration.
+func maskConfig(config string) string {
+	config = passwordPattern.ReplaceAllString(config, "${1}******")
+	return userinfoPattern.ReplaceAllString(config, "${1}:******@")
+}
+
+func writeJSON(ctx *macaron.Context, status int, v interface{}) {
+	ctx.Resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	ctx.Resp.WriteHeader(status)
+	_ = json.NewEncoder(ctx.Resp).Encode(v)
+}
+
+func writeError(ctx *macaron.Context, status int, err error) {
+	writeJSON(ctx, status, map[string]string{"error": err.Error()})
+}
+
+func writeDeleted(ctx *macaron.Context, n int, err error) {
+	switch {
+	case err == ErrScanUnsupported:
+		writeError(ctx, http.StatusNotImplemented, err)
+	case err != nil:
+		writeJSON(ctx, http.StatusInternalServerError, map[string]interface{}{
+			"deleted": n,
+			"error":   err.Error(),
+		})
+	default:
+		writeJSON(ctx, http.StatusOK, map[string]int{"deleted": n})
+	}
+}
+
+// adminEntry is the description of a cached value returned by the endpoints.
+type adminEntry struct {
+	Key   string `json:"key"`
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Size of the encoded value in bytes, -1 if unknown.
+	Size int64 `json:"size"`
+	// Seconds before the value expires, -1 if it does not expire, absent if unknown.
+	TTL *int64 `json:"ttl,omitempty"`
+}
+
+func newAdminEntry(e Entry, now time.Time) adminEntry {
+	ttl := int64(e.TTL(now) / time.Second)
+	if e.Expires.IsZero() {
+		ttl = -1
+	}
+	return adminEntry{
+		Key:  e.Key,
+		Size: e.Size,
+		TTL:  &ttl,
+	}
+}
+
+// Admin registers endpoints for inspecting the cache.Cache mapped by Cacher under given prefix:
+//
+//	GET    <prefix>/key?name=<key>                  looks up a value, its TTL and encoded size
+//	DELETE <prefix>/key?name=<key>                  deletes a value
+//	GET    <prefix>/keys?pattern=<glob>&limit=<n>   lists keys matching the pattern, see MatchPattern
+//	DELETE <prefix>/keys?pattern=<glob>             deletes values whose key matches the pattern
+//	DELETE <prefix>/namespace?prefix=<prefix>       deletes values whose key starts with the prefix
+//	GET    <prefix>/stats                           shows statistics of the adapter
+//	GET    <prefix>/config                          shows configuration of the adapter
+//
+// Listing and deleting multiple keys require the adapter to implement Scanner. For example:
+//
+//	cache.Admin(m.Router, "/debug/cache", cache.AdminOptions{Auth: isAdmin})
+//
+// An single variadic cache.AdminOptions struct can be optionally provided to configure.
+func Admin(r *macaron.Router, prefix string, options ...AdminOptions) {
+	opt := prepareAdminOptions(options)
+
+	r.Group(prefix, func() {
+		r.Get("/key", func(ctx *macaron.Context, c Cache) {
+			key := ctx.Query("name")
+			val := c.Get(key)
+			if val == nil {
+				writeError(ctx, http.StatusNotFound, fmt.Errorf("key '%s' not exist", key))
+				return
+			}
+
+			e := adminEntry{Key: key, Size: -1}
+			if scanner, ok := c.(Scanner); ok {
+				if info, ok := scanner.Inspect(key); ok {
+					e = newAdminEntry(info, opt.Options.Clock.Now())
+				}
+			}
+			e.Type = fmt.Sprintf("%T", val)
+			e.Value = fmt.Sprint(val)
+			if b, ok := val.([]byte); ok {
+				e.Value = string(b)
+			}
+			writeJSON(ctx, http.StatusOK, e)
+		})
+
+		r.Delete("/key", func(ctx *macaron.Context, c Cache) {
+			key := ctx.Query("name")
+			if !c.IsExist(key) {
+				writeError(ctx, http.StatusNotFound, fmt.Errorf("key '%s' not exist", key))
+				return
+			}
+			if err := c.Delete(key); err != nil {
+				writeError(ctx, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(ctx, http.StatusOK, map[string]int{"deleted": 1})
+		})
+
+		r.Get("/keys", func(ctx *macaron.Context, c Cache) {
+			scanner, ok := c.(Scanner)
+			if !ok {
+				writeError(ctx, http.StatusNotImplemented, ErrScanUnsupported)
+				return
+			}
+
+			pattern := ctx.QueryTrim("pattern")
+			if len(pattern) == 0 {
+				pattern = "*"
+			}
+			match := patternRegexp(pattern).MatchString
+			limit := ctx.QueryInt("limit")
+			if limit <= 0 {
+				limit = 100
+			}
+
+			now := opt.Options.Clock.Now()
+			entries := make([]adminEntry, 0)
+			truncated := false
+			if err := scanner.Scan(func(e Entry) bool {
+				if !match(e.Key) {
+					return true
+				} else if len(entries) == limit {
+					truncated = true
+					return false
+				}
+				entries = append(entries, newAdminEntry(e, now))
+				return true
+			}); err != nil {
+				writeError(ctx, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(ctx, http.StatusOK, map[string]interface{}{
+				"keys":      entries,
+				"truncated": truncated,
+			})
+		})
+
+		r.Delete("/keys", func(ctx *macaron.Context, c Cache) {
+			pattern := ctx.QueryTrim("pattern")
+			if len(pattern) == 0 {
+				writeError(ctx, http.StatusBadRequest, errors.New("pattern is required"))
+				return
+			}
+			n, err := DeletePattern(c, pattern)
+			writeDeleted(ctx, n, err)
+		})
+
+		r.Delete("/namespace", func(ctx *macaron.Context, c Cache) {
+			prefix := ctx.QueryTrim("prefix")
+			if len(prefix) == 0 {
+				writeError(ctx, http.StatusBadRequest, errors.New("prefix is required"))
+				return
+			}
+			n, err := FlushPrefix(c, prefix)
+			writeDeleted(ctx, n, err)
+		})
+
+		r.Get("/stats", func(ctx *macaron.Context, c Cache) {
+			stats := map[string]int64{}
+			if reporter, ok := c.(StatsReporter); ok {
+				stats = reporter.Stats()
+			}
+			writeJSON(ctx, http.StatusOK, map[string]interface{}{
+				"adapter": opt.Options.Adapter,
+				"stats":   stats,
+			})
+		})
+
+		r.Get("/config", func(ctx *macaron.Context) {
+			writeJSON(ctx, http.StatusOK, map[string]interface{}{
+				"adapter":        opt.Options.Adapter,
+				"adapter_config": maskConfig(opt.Options.AdapterConfig),
+				"interval":       opt.Options.Interval,
+				"occupy_mode":    opt.Options.OccupyMode,
+				"section":        opt.Options.Section,
+			})
+		})
+	}, func(ctx *macaron.Context) {
+		if !opt.Auth(ctx) {
+			writeError(ctx, http.StatusForbidden, errors.New("access denied"))
+		}
+	})
+}
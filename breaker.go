@@ -0,0 +1,364 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by counter operations while the circuit is open.
+var ErrCircuitOpen = errors.New("cache: circuit breaker is open")
+
+// BreakerState represents the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all calls fast.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe calls through.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerOptions represents a struct for specifying configuration options for the circuit breaker.
+type BreakerOptions struct {
+	// Error rate between 0 and 1 that opens the circuit. Default is 0.5.
+	ErrorRate float64
+	// Minimum number of calls in a window before the error rate is evaluated. Default is 20.
+	MinRequests int
+	// Period after which call statistics are reset. Default is 10 seconds.
+	Window time.Duration
+	// Time the circuit stays open before letting probe calls through. Default is 5 seconds.
+	OpenTimeout time.Duration
+	// Number of successful probe calls required to close the circuit. Default is 1.
+	// As Get and IsExist cannot tell failures, only writes and counter operations
+	// are successful probes.
+	HalfOpenRequests int
+	// Calls lasting longer than this in real time are counted as failures. Default
+	// is 1 second, negative disables it. This is the only way failures of Get and
+	// IsExist are detected, they are not counted otherwise.
+	SlowCall time.Duration
+	// IsFailure reports whether an error counts as a failure. Default counts errors
+	// of the transport or backend, as told by the adapter's RetryClassifier if it
+	// implements one and IsTransientError otherwise, but not errors such as a
+	// missing key of Incr.
+	IsFailure func(error) bool
+	// Clock used for the window and open timeout. Default is the Clock of
+	// Options given to StartAndGC, or DefaultClock.
+	Clock Clock
+	// OnStateChange is called after the state has changed. Default logs the change.
+	OnStateChange func(from, to BreakerState)
+}
+
+func prepareBreakerOptions(c Cache, opt BreakerOptions) BreakerOptions {
+	if opt.ErrorRate <= 0 {
+		opt.ErrorRate = 0.5
+	}
+	if opt.MinRequests < 1 {
+		opt.MinRequests = 20
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.OpenTimeout <= 0 {
+		opt.OpenTimeout = 5 * time.Second
+	}
+	if opt.HalfOpenRequests < 1 {
+		opt.HalfOpenRequests = 1
+	}
+	if opt.SlowCall == 0 {
+		opt.SlowCall = time.Second
+	}
+	if opt.IsFailure == nil {
+		opt.IsFailure = isBackendFailure(c)
+	}
+	if opt.OnStateChange == nil {
+		opt.OnStateChange = func(from, to BreakerState) {
+			log.Printf("cache: circuit breaker changed from %s to %s", from, to)
+		}
+	}
+	return opt
+}
+
+// isBackendFailure returns a function that reports whether an error
+// of given adapter comes from its transport or backend.
+func isBackendFailure(c Cache) func(error) bool {
+	classify := IsTransientError
+	if rc, ok := c.(RetryClassifier); ok {
+		classify = rc.IsRetryable
+	}
+	return func(err error) bool {
+		return err == ErrNoReplica || err == ErrReplicaTimeout || classify(err)
+	}
+}
+
+// CircuitBreaker is a cache wrapper that stops calling a degraded adapter.
+// While the circuit is open, reads are treated as misses, Put, Delete and Flush
+// are no-ops, and Incr, Decr and IncrBy return ErrCircuitOpen.
+type CircuitBreaker struct {
+	c   Cache
+	opt BreakerOptions
+
+	lock        sync.Mutex
+	clock       Clock
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// NewCircuitBreaker wraps given cache with a circuit breaker.
+func NewCircuitBreaker(c Cache, opt BreakerOptions) *CircuitBreaker {
+	clock := opt.Clock
+	if clock == nil {
+		clock = DefaultClock
+	}
+	return &CircuitBreaker{
+		c:           c,
+		opt:         prepareBreakerOptions(c, opt),
+		clock:       clock,
+		windowStart: clock.Now(),
+	}
+}
+
+// State returns current state of the circuit.
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// setState must be called with lock held.
+func (b *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.requests, b.failures = 0, 0
+	b.probes, b.successes = 0, 0
+	b.windowStart = now
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+}
+
+// allow reports whether a call is let through.
+func (b *CircuitBreaker) allow() bool {
+	b.lock.Lock()
+	from := b.state
+	allowed := true
+	now := b.clock.Now()
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.opt.Window {
+			b.setState(BreakerClosed, now)
+		}
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.opt.OpenTimeout {
+			allowed = false
+			break
+		}
+		b.setState(BreakerHalfOpen, now)
+		b.probes++
+	case BreakerHalfOpen:
+		if b.probes >= b.opt.HalfOpenRequests {
+			allowed = false
+			break
+		}
+		b.probes++
+	}
+	to := b.state
+	b.lock.Unlock()
+
+	if from != to {
+		b.opt.OnStateChange(from, to)
+	}
+	return allowed
+}
+
+// done records the outcome of a call that was let through.
+func (b *CircuitBreaker) done(start time.Time, err error) {
+	failed := err != nil && b.opt.IsFailure(err)
+	if b.opt.SlowCall > 0 && time.Since(start) > b.opt.SlowCall {
+		failed = true
+	}
+
+	b.lock.Lock()
+	from := b.state
+	now := b.clock.Now()
+	switch b.state {
+	case BreakerClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.opt.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.opt.ErrorRate {
+			b.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen, now)
+			break
+		}
+		b.successes++
+		if b.successes >= b.opt.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	}
+	to := b.state
+	b.lock.Unlock()
+
+	if from != to {
+		b.opt.OnStateChange(from, to)
+	}
+}
+
+// doneRead records the outcome of a read that was let through. Reads report
+// errors as misses, so only a slow one is counted, others give back their
+// probe call to not close a half-open circuit nor dilute the error rate.
+func (b *CircuitBreaker) doneRead(start time.Time) {
+	if b.opt.SlowCall > 0 && time.Since(start) > b.opt.SlowCall {
+		b.done(start, nil)
+		return
+	}
+
+	b.lock.Lock()
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+	b.lock.Unlock()
+}
+
+// Put puts value into cache with key and expire time.
+func (b *CircuitBreaker) Put(key string, val interface{}, expire int64) error {
+	if !b.allow() {
+		return nil
+	}
+	start := time.Now()
+	err := b.c.Put(key, val, expire)
+	b.done(start, err)
+	return err
+}
+
+// Get gets cached value by given key.
+func (b *CircuitBreaker) Get(key string) interface{} {
+	if !b.allow() {
+		return nil
+	}
+	start := time.Now()
+	val := b.c.Get(key)
+	b.doneRead(start)
+	return val
+}
+
+// Delete deletes cached value by given key.
+func (b *CircuitBreaker) Delete(key string) error {
+	if !b.allow() {
+		return nil
+	}
+	start := time.Now()
+	err := b.c.Delete(key)
+	b.done(start, err)
+	return err
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (b *CircuitBreaker) Incr(key string) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	start := time.Now()
+	err := b.c.Incr(key)
+	b.done(start, err)
+	return err
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (b *CircuitBreaker) Decr(key string) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	start := time.Now()
+	err := b.c.Decr(key)
+	b.done(start, err)
+	return err
+}
+
+// IncrBy adds delta to the counter of given key, it returns ErrCounterUnsupported
+// if the wrapped adapter does not implement Counter.
+func (b *CircuitBreaker) IncrBy(key string, delta, expire int64) (int64, error) {
+	counter, ok := b.c.(Counter)
+	if !ok {
+		return 0, ErrCounterUnsupported
+	}
+	if !b.allow() {
+		return 0, ErrCircuitOpen
+	}
+	start := time.Now()
+	n, err := counter.IncrBy(key, delta, expire)
+	b.done(start, err)
+	return n, err
+}
+
+// IsExist returns true if cached value exists.
+func (b *CircuitBreaker) IsExist(key string) bool {
+	if !b.allow() {
+		return false
+	}
+	start := time.Now()
+	exist := b.c.IsExist(key)
+	b.doneRead(start)
+	return exist
+}
+
+// Flush deletes all cached data.
+func (b *CircuitBreaker) Flush() error {
+	if !b.allow() {
+		return nil
+	}
+	start := time.Now()
+	err := b.c.Flush()
+	b.done(start, err)
+	return err
+}
+
+// StartAndGC starts the wrapped adapter, and uses the Clock of given options
+// unless one was set in BreakerOptions.
+func (b *CircuitBreaker) StartAndGC(opt Options) error {
+	if b.opt.Clock == nil && opt.Clock != nil {
+		b.lock.Lock()
+		b.clock = opt.Clock
+		b.setState(b.state, b.clock.Now())
+		b.lock.Unlock()
+	}
+	return b.c.StartAndGC(opt)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	Convey("Test circuit breaker", t, func() {
+		flaky := newFlakyCacher()
+		So(flaky.StartAndGC(Options{}), ShouldBeNil)
+
+		var changes []BreakerState
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		b := NewCircuitBreaker(flaky, BreakerOptions{
+			Clock:       clock,
+			MinRequests: 4,
+			OpenTimeout: 100 * time.Millisecond,
+			SlowCall:    50 * time.Millisecond,
+			OnStateChange: func(from, to BreakerState) {
+				changes = append(changes, to)
+			},
+		})
+
+		So(b.Put("uname", "unknwon", 0), ShouldBeNil)
+		So(b.Get("uname"), ShouldEqual, "unknwon")
+		So(b.State(), ShouldEqual, BreakerClosed)
+
+		Convey("Open on errors and fail fast", func() {
+			// Reads without errors do not dilute the error rate.
+			for i := 0; i < 10; i++ {
+				So(b.Get("uname"), ShouldEqual, "unknwon")
+			}
+			atomic.StoreInt32(&flaky.down, 1)
+			So(b.Put("uname", "unknwon", 0), ShouldNotBeNil)
+			So(b.Put("uname", "unknwon", 0), ShouldNotBeNil)
+			So(b.Put("uname", "unknwon", 0), ShouldNotBeNil)
+			So(b.State(), ShouldEqual, BreakerOpen)
+
+			So(b.Put("uname", "unknwon", 0), ShouldBeNil)
+			So(b.Get("uname"), ShouldBeNil)
+			So(b.IsExist("uname"), ShouldBeFalse)
+			So(b.Incr("uname"), ShouldEqual, ErrCircuitOpen)
+
+			Convey("Close after a successful probe", func() {
+				atomic.StoreInt32(&flaky.down, 0)
+				clock.Advance(100 * time.Millisecond)
+				So(b.Get("uname"), ShouldEqual, "unknwon")
+				So(b.State(), ShouldEqual, BreakerHalfOpen)
+				So(b.Put("uname", "unknwon", 0), ShouldBeNil)
+				So(b.State(), ShouldEqual, BreakerClosed)
+				So(changes, ShouldResemble, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed})
+			})
+
+			Convey("Reopen after a failed probe", func() {
+				clock.Advance(100 * time.Millisecond)
+				So(b.Put("uname", "unknwon", 0), ShouldNotBeNil)
+				So(b.State(), ShouldEqual, BreakerOpen)
+				So(changes, ShouldResemble, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen})
+			})
+		})
+
+		Convey("Ignore errors that are not failures of the backend", func() {
+			for i := 0; i < 4; i++ {
+				So(b.Incr("missing"), ShouldNotBeNil)
+			}
+			So(b.State(), ShouldEqual, BreakerClosed)
+		})
+
+		Convey("Open on slow calls", func() {
+			atomic.StoreInt32(&flaky.slow, 1)
+			for i := 0; i < 3; i++ {
+				b.Get("uname")
+			}
+			So(b.State(), ShouldEqual, BreakerOpen)
+		})
+	})
+}
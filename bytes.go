@@ -0,0 +1,618 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BytesDefaultMaxBytes is the memory budget of the bytes adapter when Options.MaxBytes is not set.
+const BytesDefaultMaxBytes = 64 << 20
+
+// Layout of an entry in the buffer of a shard:
+//
+//	size    uint32  total size of the entry
+//	created int64   Unix time the value was put
+//	expire  int64   expire time in seconds, 0 if it does not expire
+//	hash    uint64  hash of the key
+//	codec   uint8   codec of the value
+//	keyLen  uint16  length of the key
+//	key, value
+const (
+	bytesHeaderSize = 4 + 8 + 8 + 8 + 1 + 2
+	bytesMaxKeyLen  = 1<<16 - 1
+)
+
+// Codecs of values in entries, integers are stored as varints
+// so that counters do not need to be encoded by gob.
+const (
+	bytesString uint8 = iota + 1
+	bytesBytes
+	bytesGob
+	bytesInt
+	bytesInt32
+	bytesInt64
+	bytesUint
+	bytesUint32
+	bytesUint64
+)
+
+// encodeBytesValue returns the codec and encoded form of given value.
+func encodeBytesValue(val interface{}) (uint8, []byte) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	switch v := val.(type) {
+	case int:
+		return bytesInt, buf[:binary.PutVarint(buf, int64(v))]
+	case int32:
+		return bytesInt32, buf[:binary.PutVarint(buf, int64(v))]
+	case int64:
+		return bytesInt64, buf[:binary.PutVarint(buf, v)]
+	case uint:
+		return bytesUint, buf[:binary.PutUvarint(buf, uint64(v))]
+	case uint32:
+		return bytesUint32, buf[:binary.PutUvarint(buf, uint64(v))]
+	case uint64:
+		return bytesUint64, buf[:binary.PutUvarint(buf, v)]
+	}
+
+	switch codec, data := encodeValue(val); codec {
+	case CodecString:
+		return bytesString, data
+	case CodecBytes:
+		return bytesBytes, data
+	default:
+		return bytesGob, data
+	}
+}
+
+// decodeBytesValue returns a copy of the encoded value that does not refer to data.
+func decodeBytesValue(codec uint8, data []byte) (interface{}, error) {
+	switch codec {
+	case bytesString:
+		return string(data), nil
+	case bytesBytes:
+		return append([]byte(nil), data...), nil
+	case bytesGob:
+		return decodeValue(CodecGob, data)
+	case bytesInt, bytesInt32, bytesInt64:
+		v, _ := binary.Varint(data)
+		switch codec {
+		case bytesInt:
+			return int(v), nil
+		case bytesInt32:
+			return int32(v), nil
+		}
+		return v, nil
+	case bytesUint, bytesUint32, bytesUint64:
+		v, _ := binary.Uvarint(data)
+		switch codec {
+		case bytesUint:
+			return uint(v), nil
+		case bytesUint32:
+			return uint32(v), nil
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported codec %d", codec)
+}
+
+// fnv64 returns the FNV-1a hash of given key.
+func fnv64(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// bytesEntry is an entry read from the buffer of a shard, it refers to the buffer.
+type bytesEntry []byte
+
+func (e bytesEntry) size() int      { return int(binary.LittleEndian.Uint32(e[0:])) }
+func (e bytesEntry) created() int64 { return int64(binary.LittleEndian.Uint64(e[4:])) }
+func (e bytesEntry) expire() int64  { return int64(binary.LittleEndian.Uint64(e[12:])) }
+func (e bytesEntry) hash() uint64   { return binary.LittleEndian.Uint64(e[20:]) }
+func (e bytesEntry) codec() uint8   { return e[28] }
+func (e bytesEntry) keyLen() int    { return int(binary.LittleEndian.Uint16(e[29:])) }
+
+func (e bytesEntry) key() string {
+	return string(e[bytesHeaderSize : bytesHeaderSize+e.keyLen()])
+}
+
+func (e bytesEntry) hasKey(key string) bool {
+	return e.keyLen() == len(key) && string(e[bytesHeaderSize:bytesHeaderSize+len(key)]) == key
+}
+
+func (e bytesEntry) value() []byte {
+	return e[bytesHeaderSize+e.keyLen() : e.size()]
+}
+
+func (e bytesEntry) hasExpired(now time.Time) bool {
+	return e.expire() > 0 && now.Unix()-e.created() >= e.expire()
+}
+
+// decode returns a copy of the value that does not refer to the buffer.
+func (e bytesEntry) decode() (interface{}, error) {
+	return decodeBytesValue(e.codec(), e.value())
+}
+
+// bytesShard keeps entries in a ring buffer in the order they were put,
+// with an index from hash of the key to the offset of the entry. Neither
+// contains pointers, so the Go GC does not scan them. Replaced and deleted
+// entries stay in the buffer until the oldest entries are evicted to make room.
+type bytesShard struct {
+	lock      sync.RWMutex
+	index     map[uint64]uint32
+	buf       []byte
+	head      int  // Offset of the oldest entry.
+	tail      int  // Offset the next entry is written at.
+	end       int  // End of entries before the buffer wrapped around.
+	wrapped   bool // True if entries from head to end are followed by ones from 0 to tail.
+	entries   int  // Number of entries in the buffer, including replaced and deleted ones.
+	used      int64
+	evictions int64
+}
+
+func newBytesShard(size int) *bytesShard {
+	return &bytesShard{
+		index: make(map[uint64]uint32),
+		buf:   make([]byte, size),
+	}
+}
+
+func (s *bytesShard) entry(offset int) bytesEntry {
+	e := bytesEntry(s.buf[offset:])
+	return e[:e.size()]
+}
+
+// lookup returns the entry of given key, it must be called with the lock held.
+func (s *bytesShard) lookup(key string, hash uint64) (bytesEntry, bool) {
+	offset, ok := s.index[hash]
+	if !ok {
+		return nil, false
+	}
+	e := s.entry(int(offset))
+	return e, e.hasKey(key)
+}
+
+// pop removes the oldest entry, and returns true if it was still indexed.
+// It must be called with the lock held.
+func (s *bytesShard) pop() bool {
+	e := s.entry(s.head)
+	offset, indexed := s.index[e.hash()]
+	indexed = indexed && int(offset) == s.head
+	if indexed {
+		delete(s.index, e.hash())
+	}
+
+	s.head += e.size()
+	s.used -= int64(e.size())
+	s.entries--
+	if s.wrapped && s.head == s.end {
+		s.head = 0
+		s.wrapped = false
+	} else if s.entries == 0 {
+		s.head, s.tail, s.wrapped = 0, 0, false
+	}
+	return indexed
+}
+
+// push writes an entry and indexes it, oldest entries are evicted to make room.
+// It must be called with the lock held.
+func (s *bytesShard) push(key string, hash uint64, codec uint8, val []byte, created, expire int64) {
+	size := bytesHeaderSize + len(key) + len(val)
+	for {
+		if !s.wrapped && s.tail+size <= len(s.buf) {
+			break
+		} else if !s.wrapped && size <= s.head {
+			s.end = s.tail
+			s.tail = 0
+			s.wrapped = true
+			continue
+		} else if s.wrapped && s.tail+size <= s.head {
+			break
+		}
+		if s.pop() {
+			s.evictions++
+		}
+	}
+
+	e := bytesEntry(s.buf[s.tail : s.tail+size])
+	binary.LittleEndian.PutUint32(e[0:], uint32(size))
+	binary.LittleEndian.PutUint64(e[4:], uint64(created))
+	binary.LittleEndian.PutUint64(e[12:], uint64(expire))
+	binary.LittleEndian.PutUint64(e[20:], hash)
+	e[28] = codec
+	binary.LittleEndian.PutUint16(e[29:], uint16(len(key)))
+	copy(e[bytesHeaderSize:], key)
+	copy(e[bytesHeaderSize+len(key):], val)
+
+	s.index[hash] = uint32(s.tail)
+	s.tail += size
+	s.used += int64(size)
+	s.entries++
+}
+
+// gc evicts the oldest entries while they are expired, replaced or deleted.
+func (s *bytesShard) gc(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for s.entries > 0 {
+		e := s.entry(s.head)
+		offset, indexed := s.index[e.hash()]
+		if indexed && int(offset) == s.head && !e.hasExpired(now) {
+			return
+		}
+		s.pop()
+	}
+}
+
+func (s *bytesShard) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.index = make(map[uint64]uint32)
+	s.head, s.tail, s.end, s.wrapped = 0, 0, 0, false
+	s.entries = 0
+	s.used = 0
+}
+
+// BytesCacher represents a cache adapter that keeps serialized values in large
+// pre-allocated byte buffers, so that the Go GC does not scan millions of entries.
+// Values other than strings, byte slices and integers are encoded by gob,
+// so their types must be registered by gob.Register. The total size of entries is bounded by
+// Options.MaxBytes, oldest entries are evicted first to make room for new ones.
+// Keys whose hashes collide replace each other.
+type BytesCacher struct {
+	hits     int64 // Accessed atomically.
+	misses   int64 // Accessed atomically.
+	lock     sync.Mutex
+	state    atomic.Value // *bytesState, replaced by StartAndGC.
+	interval int          // GC interval.
+}
+
+// bytesState holds the buffers of a BytesCacher and the clock they are used with.
+type bytesState struct {
+	shards []*bytesShard
+	clock  Clock
+}
+
+// NewBytesCacher creates and returns a new bytes cacher.
+// It allocates its buffers in StartAndGC.
+func NewBytesCacher() *BytesCacher {
+	return &BytesCacher{}
+}
+
+// errBytesNotStarted is returned by writes before buffers are allocated by StartAndGC.
+var errBytesNotStarted = errors.New("cache/bytes: not started")
+
+// loadState returns the current buffers and clock, or nil before StartAndGC.
+func (c *BytesCacher) loadState() *bytesState {
+	st, _ := c.state.Load().(*bytesState)
+	return st
+}
+
+// shard returns the shard of given hash and the clock, or a nil shard before StartAndGC.
+func (c *BytesCacher) shard(hash uint64) (*bytesShard, Clock) {
+	st := c.loadState()
+	if st == nil {
+		return nil, nil
+	}
+	return st.shards[hash%uint64(len(st.shards))], st.clock
+}
+
+// put encodes and writes the value, it must be called with the lock of the shard held.
+func (c *BytesCacher) put(s *bytesShard, key string, hash uint64, val interface{}, expire int64, now time.Time) error {
+	codec, data := encodeBytesValue(val)
+	if len(key) > bytesMaxKeyLen {
+		return fmt.Errorf("cache/bytes: key of %d bytes is too long", len(key))
+	} else if size := bytesHeaderSize + len(key) + len(data); size > len(s.buf) {
+		return fmt.Errorf("cache/bytes: entry of %d bytes for '%s' is larger than a shard", size, key)
+	}
+	s.push(key, hash, codec, data, now.Unix(), expire)
+	return nil
+}
+
+// Put puts value into cache with key and expire time.
+// If expired is 0, it lives until it is evicted.
+func (c *BytesCacher) Put(key string, val interface{}, expire int64) error {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return errBytesNotStarted
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return c.put(s, key, hash, val, expire, clock.Now())
+}
+
+func (c *BytesCacher) get(key string) (interface{}, error) {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return nil, nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.lookup(key, hash)
+	if !ok || e.hasExpired(clock.Now()) {
+		return nil, nil
+	}
+	return e.decode()
+}
+
+// Get gets cached value by given key.
+func (c *BytesCacher) Get(key string) interface{} {
+	val, err := c.get(key)
+	if err != nil {
+		val = nil
+	}
+	if val == nil {
+		atomic.AddInt64(&c.misses, 1)
+	} else {
+		atomic.AddInt64(&c.hits, 1)
+	}
+	return val
+}
+
+// Delete deletes cached value by given key.
+func (c *BytesCacher) Delete(key string) error {
+	hash := fnv64(key)
+	s, _ := c.shard(hash)
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.lookup(key, hash); ok {
+		delete(s.index, hash)
+	}
+	return nil
+}
+
+// update replaces the value by given key with the one returned by fn,
+// keeping its expire time.
+func (c *BytesCacher) update(key string, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return nil, errors.New("key not exist")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.lookup(key, hash)
+	if !ok || e.hasExpired(clock.Now()) {
+		return nil, errors.New("key not exist")
+	}
+	val, err := e.decode()
+	if err != nil {
+		return nil, err
+	}
+	if val, err = fn(val); err != nil {
+		return nil, err
+	}
+
+	created, expire := e.created(), e.expire()
+	codec, data := encodeBytesValue(val)
+	s.push(key, hash, codec, data, created, expire)
+	return val, nil
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *BytesCacher) Incr(key string) error {
+	_, err := c.update(key, Incr)
+	return err
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (c *BytesCacher) Decr(key string) error {
+	_, err := c.update(key, Decr)
+	return err
+}
+
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *BytesCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return 0, errBytesNotStarted
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.lookup(key, hash)
+	if !ok || e.hasExpired(clock.Now()) {
+		return delta, c.put(s, key, hash, delta, expire, clock.Now())
+	}
+
+	val, err := e.decode()
+	if err != nil {
+		return 0, err
+	}
+	if val, err = IncrBy(val, delta); err != nil {
+		return 0, err
+	}
+	created, expire := e.created(), e.expire()
+	codec, data := encodeBytesValue(val)
+	s.push(key, hash, codec, data, created, expire)
+	return ToInt64(val)
+}
+
+// IsExist returns true if cached value exists.
+func (c *BytesCacher) IsExist(key string) bool {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.lookup(key, hash)
+	return ok && !e.hasExpired(clock.Now())
+}
+
+// Flush deletes all cached data.
+func (c *BytesCacher) Flush() error {
+	st := c.loadState()
+	if st == nil {
+		return nil
+	}
+	for _, s := range st.shards {
+		s.reset()
+	}
+	return nil
+}
+
+// Inspect describes cached value by given key, it returns false if the value does not exist.
+// Size of the value is the size of its encoded form.
+func (c *BytesCacher) Inspect(key string) (Entry, bool) {
+	hash := fnv64(key)
+	s, clock := c.shard(hash)
+	if s == nil {
+		return Entry{}, false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.lookup(key, hash)
+	if !ok || e.hasExpired(clock.Now()) {
+		return Entry{}, false
+	}
+	return NewEntry(key, int64(len(e.value())), e.created(), e.expire()), true
+}
+
+// Scan calls fn with every cached value in no particular order until fn returns false.
+func (c *BytesCacher) Scan(fn func(Entry) bool) error {
+	st := c.loadState()
+	if st == nil {
+		return nil
+	}
+	now := st.clock.Now()
+	for _, s := range st.shards {
+		var entries []Entry
+		s.lock.RLock()
+		for _, offset := range s.index {
+			e := s.entry(int(offset))
+			if !e.hasExpired(now) {
+				entries = append(entries, NewEntry(e.key(), int64(len(e.value())), e.created(), e.expire()))
+			}
+		}
+		s.lock.RUnlock()
+
+		for _, e := range entries {
+			if !fn(e) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns number of indexed items including expired ones not yet evicted,
+// bytes used by entries in buffers and their capacity, number of live items
+// evicted to make room, number of hits and misses of Get, and number of shards.
+func (c *BytesCacher) Stats() map[string]int64 {
+	var shards []*bytesShard
+	if st := c.loadState(); st != nil {
+		shards = st.shards
+	}
+	stats := map[string]int64{
+		"hits":   atomic.LoadInt64(&c.hits),
+		"misses": atomic.LoadInt64(&c.misses),
+		"shards": int64(len(shards)),
+	}
+	for _, s := range shards {
+		s.lock.RLock()
+		stats["items"] += int64(len(s.index))
+		stats["bytes"] += s.used
+		stats["capacity"] += int64(len(s.buf))
+		stats["evictions"] += s.evictions
+		s.lock.RUnlock()
+	}
+	return stats
+}
+
+func (c *BytesCacher) startGC() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	st := c.loadState()
+	if c.interval < 1 || st == nil {
+		return
+	}
+
+	now := st.clock.Now()
+	for _, s := range st.shards {
+		s.gc(now)
+	}
+
+	st.clock.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+}
+
+// Close stops the GC routine, cached values are kept.
+func (c *BytesCacher) Close() error {
+	c.lock.Lock()
+	c.interval = 0
+	c.lock.Unlock()
+	return nil
+}
+
+// StartAndGC allocates buffers of Options.MaxBytes in total and starts GC routine
+// that evicts the oldest entries while they are expired. Cached values are dropped.
+func (c *BytesCacher) StartAndGC(opt Options) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.interval = opt.Interval
+	clock := opt.Clock
+	if clock == nil {
+		clock = DefaultClock
+	}
+
+	maxBytes := opt.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = BytesDefaultMaxBytes
+	}
+	n := memoryShardCount(0, maxBytes)
+	size := maxBytes / int64(n)
+	if size > 1<<32-1 {
+		return fmt.Errorf("cache/bytes: shards of %d bytes are too large", size)
+	}
+	shards := make([]*bytesShard, n)
+	for i := range shards {
+		shards[i] = newBytesShard(int(size))
+	}
+	c.state.Store(&bytesState{shards, clock})
+
+	clock.AfterFunc(0, func() { c.startGC() })
+	return nil
+}
+
+func init() {
+	Register("bytes", NewBytesCacher())
+}
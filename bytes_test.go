@@ -0,0 +1,200 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_BytesCacher(t *testing.T) {
+	Convey("Test bytes cache adapter", t, func() {
+		testAdapter(Options{
+			Adapter:  "bytes",
+			Interval: 2,
+		})
+	})
+
+	Convey("Miss before buffers are allocated", t, func() {
+		c := NewBytesCacher()
+		So(c.Put("uname", "unknwon", 0), ShouldNotBeNil)
+		So(c.Get("uname"), ShouldBeNil)
+		So(c.IsExist("uname"), ShouldBeFalse)
+		So(c.Incr("uname"), ShouldNotBeNil)
+		_, err := c.IncrBy("uname", 1, 0)
+		So(err, ShouldNotBeNil)
+		So(c.Delete("uname"), ShouldBeNil)
+		_, ok := c.Inspect("uname")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Restart while in use", t, func() {
+		c := NewBytesCacher()
+		So(c.StartAndGC(Options{MaxBytes: 1024}), ShouldBeNil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 10; i++ {
+				_ = c.StartAndGC(Options{MaxBytes: 1024, Clock: NewFakeClock(time.Unix(1e9, 0))})
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			c.Get("uname")
+		}
+		<-done
+		So(c.Flush(), ShouldBeNil)
+	})
+
+	Convey("Keep entries in byte buffers", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewBytesCacher()
+		So(c.StartAndGC(Options{Interval: 60, MaxBytes: 1024, Clock: clock}), ShouldBeNil)
+		So(c.Stats()["shards"], ShouldEqual, 1)
+		So(c.Stats()["capacity"], ShouldEqual, 1024)
+
+		Convey("Store values of each codec", func() {
+			gob.Register(map[string]int{})
+			So(c.Put("string", "unknwon", 0), ShouldBeNil)
+			So(c.Put("bytes", []byte("macaron"), 0), ShouldBeNil)
+			So(c.Put("int", int32(42), 0), ShouldBeNil)
+			So(c.Get("string"), ShouldEqual, "unknwon")
+			So(c.Get("bytes"), ShouldResemble, []byte("macaron"))
+			So(c.Get("int"), ShouldEqual, int32(42))
+			So(c.Put("uint", uint64(1<<63), 0), ShouldBeNil)
+			So(c.Get("uint"), ShouldEqual, uint64(1<<63))
+			So(c.Put("struct", map[string]int{"gob": 1}, 0), ShouldBeNil)
+			So(c.Get("struct"), ShouldResemble, map[string]int{"gob": 1})
+			So(c.Delete("uint"), ShouldBeNil)
+			So(c.Delete("struct"), ShouldBeNil)
+
+			So(c.Put("string", "replaced", 0), ShouldBeNil)
+			So(c.Get("string"), ShouldEqual, "replaced")
+			So(c.Delete("string"), ShouldBeNil)
+			So(c.IsExist("string"), ShouldBeFalse)
+
+			n, err := c.IncrBy("count", 5, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+			n, err = c.IncrBy("count", 2, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 7)
+
+			e, ok := c.Inspect("bytes")
+			So(ok, ShouldBeTrue)
+			So(e.Size, ShouldEqual, 7)
+			So(e.Expires.IsZero(), ShouldBeTrue)
+
+			var keys []string
+			So(c.Scan(func(e Entry) bool {
+				keys = append(keys, e.Key)
+				return true
+			}), ShouldBeNil)
+			So(keys, ShouldHaveLength, 3)
+		})
+
+		Convey("Evict oldest entries to make room", func() {
+			value := strings.Repeat("v", 60)
+			for i := 0; i < 100; i++ {
+				So(c.Put("key"+strconv.Itoa(i), value+strconv.Itoa(i), 0), ShouldBeNil)
+				So(c.Get("key"+strconv.Itoa(i)), ShouldEqual, value+strconv.Itoa(i))
+			}
+			So(c.IsExist("key0"), ShouldBeFalse)
+			So(c.Get("key99"), ShouldEqual, value+"99")
+
+			stats := c.Stats()
+			So(stats["bytes"], ShouldBeLessThanOrEqualTo, 1024)
+			So(stats["items"]+stats["evictions"], ShouldEqual, 100)
+
+			So(c.Put("large", strings.Repeat("v", 1024), 0), ShouldNotBeNil)
+		})
+
+		Convey("Expire entries", func() {
+			So(c.Put("short", "value", 10), ShouldBeNil)
+			So(c.Put("long", "value", 100), ShouldBeNil)
+			clock.Advance(10 * time.Second)
+			So(c.IsExist("short"), ShouldBeFalse)
+			So(c.Get("long"), ShouldEqual, "value")
+			So(c.Incr("short"), ShouldNotBeNil)
+
+			used := c.Stats()["bytes"]
+			clock.Advance(time.Minute)
+			So(c.Stats()["bytes"], ShouldBeLessThan, used)
+			So(c.Stats()["items"], ShouldEqual, 1)
+		})
+
+		Convey("Export entries", func() {
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			var buf bytes.Buffer
+			n, err := Export(c, &buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			So(c.Flush(), ShouldBeNil)
+			So(c.IsExist("uname"), ShouldBeFalse)
+			_, err = Import(c, &buf)
+			So(err, ShouldBeNil)
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+		})
+	})
+}
+
+func BenchmarkBytesCacher_Mixed(b *testing.B) {
+	c := NewBytesCacher()
+	if err := c.StartAndGC(Options{}); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkCache(b, c, 10)
+}
+
+// benchmarkGCPause measures time of a full GC while the cache holds 500000 items.
+func benchmarkGCPause(b *testing.B, c Cache) {
+	for i := 0; i < 500000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := c.Put(key, key, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runtime.GC()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(c)
+}
+
+func BenchmarkGCPause_Memory(b *testing.B) {
+	c := NewMemoryCacher()
+	if err := c.StartAndGC(Options{}); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkGCPause(b, c)
+}
+
+func BenchmarkGCPause_Bytes(b *testing.B) {
+	c := NewBytesCacher()
+	if err := c.StartAndGC(Options{MaxBytes: 64 << 20}); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkGCPause(b, c)
+}
@@ -18,6 +18,10 @@ package cache
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
 
 	"gopkg.in/macaron.v1"
 )
@@ -48,6 +52,13 @@ type Cache interface {
 	StartAndGC(opt Options) error
 }
 
+// Pinger is implemented by adapters that can report whether their backend
+// is reachable, it is used by composite adapters for health probing.
+type Pinger interface {
+	// Ping returns an error if the backend cannot be reached.
+	Ping() error
+}
+
 // Options represents a struct for specifying configuration options for the cache middleware.
 type Options struct {
 	// Name of adapter. Default is "memory".
@@ -60,6 +71,43 @@ type Options struct {
 	OccupyMode bool
 	// Configuration section name. Default is "cache".
 	Section string
+	// Clock used for expiration and GC scheduling. Default is DefaultClock.
+	Clock Clock
+	// Maximum number of items kept by the memory adapter before some are
+	// evicted by EvictionPolicy. Default is 0, which means no limit.
+	MaxEntries int
+	// Maximum total size in bytes of keys and values kept by the memory adapter
+	// before some are evicted by EvictionPolicy, see Sizer. Default is 0, which means no limit.
+	MaxBytes int64
+	// Policy the memory adapter evicts items by when it is bounded. Default is EvictLRU.
+	EvictionPolicy EvictionPolicy
+	// File the memory adapter saves its items to in the format of Export on Close and
+	// every SnapshotInterval, and reloads items that have not expired from in StartAndGC.
+	// Default is none.
+	SnapshotFile string
+	// Interval time in seconds between snapshots of the memory adapter.
+	// Default is 0, which means snapshots are only saved on Close.
+	SnapshotInterval int
+	// Copy values put into and got from the memory adapter, so that callers mutating
+	// them do not change cached values. Values implementing Cloner are copied by Clone,
+	// other mutable values are stored encoded by EncodeGob, so their types must be
+	// registered by gob.Register as for the file adapter. Default is false.
+	IsolateValues bool
+	// Directory items evicted from the bounded memory adapter are spilled to in the
+	// format of the file adapter, and promoted back from on Get. Their types must be
+	// registered by gob.Register as for the file adapter. Default is none.
+	SpillDir string
+	// Sync files written by the file adapter to disk before they replace old ones,
+	// so that they survive power loss. Default is false.
+	FileSync bool
+	// Source of values loaded into the adapter by Cacher before it is used,
+	// values that have expired since the export are skipped. Default is none.
+	WarmupSource WarmupSource
+	// Number of values loaded concurrently from the warmup source. Default is 8.
+	WarmupConcurrency int
+	// Reports progress of warming up every 1000 values and when done.
+	// Default logs when done.
+	WarmupProgress func(WarmupProgress)
 }
 
 func prepareOptions(options []Options) Options {
@@ -81,10 +129,54 @@ func prepareOptions(options []Options) Options {
 	if len(opt.AdapterConfig) == 0 {
 		opt.AdapterConfig = sec.Key("ADAPTER_CONFIG").MustString("data/caches")
 	}
+	if opt.Clock == nil {
+		opt.Clock = DefaultClock
+	}
+	if opt.MaxEntries == 0 {
+		opt.MaxEntries = sec.Key("MAX_ENTRIES").MustInt(0)
+	}
+	if opt.MaxBytes == 0 {
+		opt.MaxBytes = sec.Key("MAX_BYTES").MustInt64(0)
+	}
+	if len(opt.EvictionPolicy) == 0 {
+		opt.EvictionPolicy = EvictionPolicy(sec.Key("EVICTION_POLICY").MustString(string(EvictLRU)))
+	}
+	if len(opt.SnapshotFile) == 0 {
+		opt.SnapshotFile = sec.Key("SNAPSHOT_FILE").String()
+	}
+	if opt.SnapshotInterval == 0 {
+		opt.SnapshotInterval = sec.Key("SNAPSHOT_INTERVAL").MustInt(0)
+	}
+	if !opt.IsolateValues {
+		opt.IsolateValues = sec.Key("ISOLATE_VALUES").MustBool(false)
+	}
+	if len(opt.SpillDir) == 0 {
+		opt.SpillDir = sec.Key("SPILL_DIR").String()
+	}
+	if !opt.FileSync {
+		opt.FileSync = sec.Key("FILE_SYNC").MustBool(false)
+	}
+	if opt.WarmupSource == nil {
+		if name := sec.Key("WARMUP_SOURCE").String(); len(name) > 0 {
+			opt.WarmupSource = WarmupFile(name)
+		}
+	}
+	if opt.WarmupConcurrency < 1 {
+		opt.WarmupConcurrency = sec.Key("WARMUP_CONCURRENCY").MustInt(8)
+	}
+	if opt.WarmupProgress == nil {
+		opt.WarmupProgress = logWarmupProgress
+	}
 
 	return opt
 }
 
+// PrepareOptions fills unset options from the configuration section loaded
+// by macaron.SetConfig and defaults, the same way Cacher does.
+func PrepareOptions(opt Options) Options {
+	return prepareOptions([]Options{opt})
+}
+
 // NewCacher creates and returns a new cacher by given adapter name and configuration.
 // It panics when given adapter isn't registered and starts GC automatically.
 func NewCacher(name string, opt Options) (Cache, error) {
@@ -103,6 +195,11 @@ func Cacher(options ...Options) macaron.Handler {
 	if err != nil {
 		panic(err)
 	}
+	if opt.WarmupSource != nil {
+		if err = warmup(cache, opt); err != nil {
+			log.Printf("cache: error warming up: %v", err)
+		}
+	}
 	return func(ctx *macaron.Context) {
 		ctx.Map(cache)
 	}
@@ -120,3 +217,46 @@ func Register(name string, adapter Cache) {
 	}
 	adapters[name] = adapter
 }
+
+// newAdapter returns a fresh, unstarted instance of the adapter registered
+// under given name, so composite adapters can hold several independently
+// configured children of the same kind.
+func newAdapter(name string) (Cache, error) {
+	adapter, ok := adapters[name]
+	if !ok {
+		return nil, fmt.Errorf("cache: unknown adapter '%s'(forgot to import?)", name)
+	}
+	t := reflect.TypeOf(adapter)
+	if t.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("cache: adapter '%s' cannot be instantiated", name)
+	}
+	return reflect.New(t.Elem()).Interface().(Cache), nil
+}
+
+// stopAdapter stops background work of given adapter started by StartAndGC,
+// if it implements io.Closer.
+func stopAdapter(c Cache) {
+	if closer, ok := c.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("cache: error stopping adapter: %v", err)
+		}
+	}
+}
+
+// childAdapter parses a child definition in form of "<adapter>:<adapter config>"
+// used by composite adapters, and returns a fresh instance of the adapter
+// along with the options it should be started with.
+func childAdapter(def string, opt Options) (Cache, Options, error) {
+	fields := strings.SplitN(def, ":", 2)
+	child, err := newAdapter(fields[0])
+	if err != nil {
+		return nil, opt, err
+	}
+
+	opt.Adapter = fields[0]
+	opt.AdapterConfig = ""
+	if len(fields) > 1 {
+		opt.AdapterConfig = fields[1]
+	}
+	return child, opt, nil
+}
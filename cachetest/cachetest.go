@@ -0,0 +1,314 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package cachetest provides a conformance test suite for cache adapters.
+package cachetest
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unknwon/com"
+
+	"github.com/go-macaron/cache"
+)
+
+// Suite describes the adapter checked by Run.
+//
+// Adapters are allowed to return values in their string form, as Redis,
+// memcache, Ledis and Nodb adapters do.
+type Suite struct {
+	// NewCache is called once for every sub-test with the clock the cache must
+	// use for expiration, and must return a started and empty cache.
+	NewCache func(clock cache.Clock) cache.Cache
+	// NewNeighbor returns a started cache that shares the backend of caches returned
+	// by NewCache under another namespace or prefix. Flush is checked to leave values
+	// of the neighbor alone, which is skipped if NewNeighbor is nil.
+	NewNeighbor func(clock cache.Clock) cache.Cache
+	// Whether caches are given the real clock, for adapters whose backend expires
+	// values by itself, so that the suite waits for expiration in real time.
+	RealClock bool
+}
+
+// RunConformance checks that caches returned by newCache satisfy the contracts
+// of cache.Cache the same way built-in adapters do. newCache is called once for
+// every sub-test and must return a started and empty cache. As the caches keep
+// their own clock, the suite waits for expiration in real time, use Suite to
+// give them a fake one instead.
+func RunConformance(t *testing.T, newCache func() cache.Cache) {
+	Suite{
+		NewCache:  func(cache.Clock) cache.Cache { return newCache() },
+		RealClock: true,
+	}.Run(t)
+}
+
+// Run checks that caches of the suite satisfy the contracts of cache.Cache
+// the same way built-in adapters do.
+func (s Suite) Run(t *testing.T) {
+	run := func(name string, test func(*testing.T, cache.Cache, *clock)) {
+		t.Run(name, func(t *testing.T) {
+			clock := s.clock()
+			test(t, s.NewCache(clock), clock)
+		})
+	}
+	run("PutGet", testPutGet)
+	run("Delete", testDelete)
+	run("TTL", testTTL)
+	run("IncrDecr", testIncrDecr)
+	run("Flush", testFlush)
+	run("TypeRoundTrip", testTypeRoundTrip)
+	run("Concurrency", testConcurrency)
+	if s.NewNeighbor != nil {
+		t.Run("FlushScope", func(t *testing.T) {
+			clock := s.clock()
+			testFlushScope(t, s.NewCache(clock), s.NewNeighbor(clock))
+		})
+	}
+}
+
+// clock is the clock given to caches, with a way to let time pass.
+type clock struct {
+	cache.Clock
+	advance func(time.Duration)
+}
+
+func (s Suite) clock() *clock {
+	if s.RealClock {
+		return &clock{cache.DefaultClock, time.Sleep}
+	}
+	fake := cache.NewFakeClock(time.Now())
+	return &clock{fake, fake.Advance}
+}
+
+// equal returns true if got is want itself or its string form.
+func equal(got, want interface{}) bool {
+	if reflect.DeepEqual(got, want) {
+		return true
+	}
+	s, ok := got.(string)
+	return ok && s == com.ToStr(want)
+}
+
+func testPutGet(t *testing.T, c cache.Cache, _ *clock) {
+	if v := c.Get("404"); v != nil {
+		t.Errorf("Get of missing key returned %v, want nil", v)
+	}
+	if c.IsExist("404") {
+		t.Error("IsExist of missing key returned true")
+	}
+
+	if err := c.Put("uname", "unknwon", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v := c.Get("uname"); !equal(v, "unknwon") {
+		t.Errorf("Get returned %v, want %q", v, "unknwon")
+	}
+	if !c.IsExist("uname") {
+		t.Error("IsExist returned false after Put")
+	}
+
+	if err := c.Put("uname", "unknwon2", 0); err != nil {
+		t.Fatalf("Put to overwrite: %v", err)
+	}
+	if v := c.Get("uname"); !equal(v, "unknwon2") {
+		t.Errorf("Get after overwrite returned %v, want %q", v, "unknwon2")
+	}
+}
+
+func testDelete(t *testing.T, c cache.Cache, _ *clock) {
+	if err := c.Put("uname", "unknwon", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Delete("uname"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if v := c.Get("uname"); v != nil {
+		t.Errorf("Get after Delete returned %v, want nil", v)
+	}
+	if c.IsExist("uname") {
+		t.Error("IsExist after Delete returned true")
+	}
+}
+
+func testTTL(t *testing.T, c cache.Cache, clock *clock) {
+	if err := c.Put("short", "unknwon", 1); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Put("forever", "unknwon", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v := c.Get("short"); !equal(v, "unknwon") {
+		t.Errorf("Get before expiration returned %v, want %q", v, "unknwon")
+	}
+
+	clock.advance(2 * time.Second)
+
+	if v := c.Get("short"); v != nil {
+		t.Errorf("Get after expiration returned %v, want nil", v)
+	}
+	if c.IsExist("short") {
+		t.Error("IsExist after expiration returned true")
+	}
+	if v := c.Get("forever"); !equal(v, "unknwon") {
+		t.Errorf("Get of key without expiration returned %v, want %q", v, "unknwon")
+	}
+}
+
+func testIncrDecr(t *testing.T, c cache.Cache, _ *clock) {
+	if err := c.Incr("404"); err == nil {
+		t.Error("Incr of missing key returned nil error")
+	}
+	if err := c.Decr("404"); err == nil {
+		t.Error("Decr of missing key returned nil error")
+	}
+
+	if err := c.Put("int", 1, 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Incr("int"); err != nil {
+			t.Fatalf("Incr: %v", err)
+		}
+	}
+	if err := c.Decr("int"); err != nil {
+		t.Fatalf("Decr: %v", err)
+	}
+	if v := c.Get("int"); !equal(v, 3) {
+		t.Errorf("Get after Incr and Decr returned %v, want 3", v)
+	}
+
+	if err := c.Put("string", "hi", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Incr("string"); err == nil {
+		t.Error("Incr of non-integer value returned nil error")
+	}
+}
+
+func testFlush(t *testing.T, c cache.Cache, _ *clock) {
+	keys := []string{"uname", "uname2", "int"}
+	for _, key := range keys {
+		if err := c.Put(key, 1, 0); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for _, key := range keys {
+		if c.IsExist(key) {
+			t.Errorf("IsExist of %q after Flush returned true", key)
+		}
+	}
+
+	if err := c.Put("uname", "unknwon", 0); err != nil {
+		t.Fatalf("Put after Flush: %v", err)
+	}
+	if v := c.Get("uname"); !equal(v, "unknwon") {
+		t.Errorf("Get after Flush and Put returned %v, want %q", v, "unknwon")
+	}
+}
+
+func testFlushScope(t *testing.T, c, neighbor cache.Cache) {
+	if err := c.Put("uname", "unknwon", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := neighbor.Put("uname", "neighbor", 0); err != nil {
+		t.Fatalf("Put to neighbor: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if c.IsExist("uname") {
+		t.Error("IsExist after Flush returned true")
+	}
+	if v := neighbor.Get("uname"); !equal(v, "neighbor") {
+		t.Errorf("Get of neighbor after Flush returned %v, want %q", v, "neighbor")
+	}
+}
+
+func testTypeRoundTrip(t *testing.T, c cache.Cache, _ *clock) {
+	vals := map[string]interface{}{
+		"string":  "unknwon",
+		"empty":   "",
+		"int":     -1,
+		"int32":   int32(32),
+		"int64":   int64(1) << 40,
+		"uint":    uint(1),
+		"uint32":  uint32(32),
+		"uint64":  uint64(1) << 40,
+		"float64": 3.14,
+		"bool":    true,
+		"bytes":   []byte("unknwon"),
+	}
+	for key, val := range vals {
+		if err := c.Put(key, val, 0); err != nil {
+			t.Errorf("Put of %T: %v", val, err)
+			continue
+		}
+		if key == "empty" {
+			// Some adapters cannot tell empty values from missing ones.
+			continue
+		}
+		if v := c.Get(key); !equal(v, val) {
+			t.Errorf("Get of %T returned %#v, want %#v", val, v, val)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, c cache.Cache, _ *clock) {
+	const (
+		workers = 8
+		ops     = 50
+	)
+
+	if err := c.Put("counter", 0, 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < ops; j++ {
+				key := "key" + strconv.Itoa(i) + "_" + strconv.Itoa(j)
+				if err := c.Put(key, j, 0); err != nil {
+					t.Errorf("Put: %v", err)
+					return
+				}
+				if v := c.Get(key); !equal(v, j) {
+					t.Errorf("Get of %q returned %v, want %d", key, v, j)
+				}
+				if err := c.Put("shared", j, 0); err != nil {
+					t.Errorf("Put: %v", err)
+				}
+				c.Get("shared")
+				c.IsExist("shared")
+				_ = c.Incr("counter")
+				if err := c.Delete(key); err != nil {
+					t.Errorf("Delete: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.Get("counter") == nil {
+		t.Error("Get of counter after concurrent Incr returned nil")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cachetest
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-macaron/cache"
+)
+
+// newCacher returns a function that starts a fresh instance of the cache
+// created by newCache with given options.
+func newCacher(t *testing.T, newCache func() cache.Cache, opt cache.Options) func(cache.Clock) cache.Cache {
+	return func(clock cache.Clock) cache.Cache {
+		c := newCache()
+		opt.Clock = clock
+		if err := c.StartAndGC(opt); err != nil {
+			t.Fatalf("StartAndGC: %v", err)
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		return c
+	}
+}
+
+func Test_MemoryConformance(t *testing.T) {
+	newCache := func() cache.Cache { return cache.NewMemoryCacher() }
+	opt := cache.Options{Interval: 1}
+	Suite{
+		NewCache:    newCacher(t, newCache, opt),
+		NewNeighbor: newCacher(t, newCache, opt),
+	}.Run(t)
+}
+
+func Test_FileConformance(t *testing.T) {
+	dir := path.Join(os.TempDir(), "data/cachetest")
+	os.RemoveAll(dir)
+	newCache := func() cache.Cache { return cache.NewFileCacher() }
+	Suite{
+		NewCache: newCacher(t, newCache, cache.Options{
+			AdapterConfig: path.Join(dir, "cache"),
+			Interval:      1,
+		}),
+		NewNeighbor: newCacher(t, newCache, cache.Options{
+			AdapterConfig: path.Join(dir, "neighbor"),
+			Interval:      1,
+		}),
+	}.Run(t)
+}
+
+func Test_RunConformance(t *testing.T) {
+	RunConformance(t, func() cache.Cache {
+		c := cache.NewMemoryCacher()
+		if err := c.StartAndGC(cache.Options{Interval: 1}); err != nil {
+			t.Fatalf("StartAndGC: %v", err)
+		}
+		return c
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timer represents a single scheduled call of a function.
+type Timer interface {
+	// Stop prevents the function from being called, it returns false
+	// if the function has already been called or the timer has been stopped.
+	Stop() bool
+}
+
+// Clock is the interface that provides current time and schedules function calls.
+type Clock interface {
+	// Now returns current time.
+	Now() time.Time
+	// AfterFunc calls f after duration d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// DefaultClock is the clock backed by package time, used when no clock is specified.
+var DefaultClock Clock = realClock{}
+
+// FakeClock is a clock that only moves when told to, it is meant for tests.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	seq   int
+	when  time.Time
+	f     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// NewFakeClock creates and returns a new fake clock set to given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock has been advanced by duration d.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.seq++
+	t := &fakeTimer{
+		clock: c,
+		seq:   c.seq,
+		when:  c.now.Add(d),
+		f:     f,
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by duration d, and synchronously calls
+// all scheduled functions that become due in the order of their due time.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	c.lock.Unlock()
+
+	for {
+		c.lock.Lock()
+		sort.Slice(c.timers, func(i, j int) bool {
+			if c.timers[i].when.Equal(c.timers[j].when) {
+				return c.timers[i].seq < c.timers[j].seq
+			}
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			c.now = end
+			c.lock.Unlock()
+			return
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.lock.Unlock()
+
+		t.f()
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_FakeClock(t *testing.T) {
+	Convey("Advance fake clock", t, func() {
+		start := time.Unix(1e9, 0)
+		clock := NewFakeClock(start)
+		So(clock.Now(), ShouldEqual, start)
+
+		var fired []string
+		clock.AfterFunc(2*time.Second, func() { fired = append(fired, "2s") })
+		clock.AfterFunc(time.Second, func() {
+			fired = append(fired, "1s")
+			clock.AfterFunc(time.Second, func() { fired = append(fired, "1s+1s") })
+		})
+		stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+		So(stopped.Stop(), ShouldBeTrue)
+		So(stopped.Stop(), ShouldBeFalse)
+
+		clock.Advance(500 * time.Millisecond)
+		So(fired, ShouldBeEmpty)
+
+		clock.Advance(2 * time.Second)
+		So(fired, ShouldResemble, []string{"1s", "2s", "1s+1s"})
+		So(clock.Now(), ShouldEqual, start.Add(2500*time.Millisecond))
+	})
+}
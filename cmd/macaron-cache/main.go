@@ -0,0 +1,326 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command macaron-cache operates caches of Macaron applications, with options
+// read from the cache section of app.ini the same way as the Cacher middleware,
+// or given by flags:
+//
+//	macaron-cache -config conf/app.ini get user:1
+//	macaron-cache -adapter redis -adapter-config addr=:6379 flush user:
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/macaron.v1"
+
+	"github.com/go-macaron/cache"
+	_ "github.com/go-macaron/cache/ledis"
+	_ "github.com/go-macaron/cache/memcache"
+	_ "github.com/go-macaron/cache/mysql"
+	_ "github.com/go-macaron/cache/nodb"
+	_ "github.com/go-macaron/cache/postgres"
+	_ "github.com/go-macaron/cache/redis"
+)
+
+// env is the environment a command runs in.
+type env struct {
+	c    cache.Cache
+	args []string
+	in   io.Reader
+	out  io.Writer
+}
+
+type command struct {
+	usage string
+	nargs [2]int // Minimum and maximum number of arguments.
+	run   func(*env) error
+}
+
+var commands = map[string]command{
+	"get":    {"get <key>", [2]int{1, 1}, get},
+	"put":    {"put <key> <value> [ttl]", [2]int{2, 3}, put},
+	"del":    {"del <key>", [2]int{1, 1}, del},
+	"incr":   {"incr <key> [delta]", [2]int{1, 2}, incr},
+	"ttl":    {"ttl <key>", [2]int{1, 1}, ttl},
+	"flush":  {"flush [prefix]", [2]int{0, 1}, flush},
+	"stats":  {"stats", [2]int{0, 0}, stats},
+	"scan":   {"scan [pattern]", [2]int{0, 1}, scan},
+	"export": {"export [file]", [2]int{0, 1}, export},
+	"import": {"import [-skip-expired] [-skip-existing] [file]", [2]int{0, 3}, importEntries},
+}
+
+func toString(val interface{}) string {
+	if b, ok := val.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(val)
+}
+
+func get(e *env) error {
+	val := e.c.Get(e.args[0])
+	if val == nil {
+		return fmt.Errorf("key '%s' not exist", e.args[0])
+	}
+	_, err := fmt.Fprintln(e.out, toString(val))
+	return err
+}
+
+func put(e *env) error {
+	var expire int64
+	if len(e.args) > 2 {
+		var err error
+		if expire, err = strconv.ParseInt(e.args[2], 10, 64); err != nil {
+			return fmt.Errorf("invalid ttl: %v", err)
+		}
+	}
+	return e.c.Put(e.args[0], e.args[1], expire)
+}
+
+func del(e *env) error {
+	if !e.c.IsExist(e.args[0]) {
+		return fmt.Errorf("key '%s' not exist", e.args[0])
+	}
+	return e.c.Delete(e.args[0])
+}
+
+func incr(e *env) error {
+	delta := int64(1)
+	if len(e.args) > 1 {
+		var err error
+		if delta, err = strconv.ParseInt(e.args[1], 10, 64); err != nil {
+			return fmt.Errorf("invalid delta: %v", err)
+		}
+	}
+	n, err := cache.Increment(e.c, e.args[0], delta, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(e.out, n)
+	return err
+}
+
+func scanner(c cache.Cache) (cache.Scanner, error) {
+	s, ok := c.(cache.Scanner)
+	if !ok {
+		return nil, cache.ErrScanUnsupported
+	}
+	return s, nil
+}
+
+// seconds returns seconds before the entry expires rounded up, or -1 if it does not expire.
+func seconds(entry cache.Entry) int64 {
+	if entry.Expires.IsZero() {
+		return -1
+	}
+	return int64((entry.TTL(time.Now()) + time.Second - 1) / time.Second)
+}
+
+func ttl(e *env) error {
+	s, err := scanner(e.c)
+	if err != nil {
+		return err
+	}
+	entry, ok := s.Inspect(e.args[0])
+	if !ok {
+		return fmt.Errorf("key '%s' not exist", e.args[0])
+	}
+	_, err = fmt.Fprintln(e.out, seconds(entry))
+	return err
+}
+
+func flush(e *env) error {
+	if len(e.args) == 0 {
+		return e.c.Flush()
+	}
+	n, err := cache.FlushPrefix(e.c, e.args[0])
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.out, "%d deleted\n", n)
+	return err
+}
+
+func stats(e *env) error {
+	reporter, ok := e.c.(cache.StatsReporter)
+	if !ok {
+		return errors.New("adapter does not report statistics")
+	}
+
+	stats := reporter.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(e.out, "%s\t%d\n", name, stats[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scan(e *env) error {
+	s, err := scanner(e.c)
+	if err != nil {
+		return err
+	}
+
+	pattern := "*"
+	if len(e.args) > 0 {
+		pattern = e.args[0]
+	}
+	w := bufio.NewWriter(e.out)
+	if err = s.Scan(func(entry cache.Entry) bool {
+		if cache.MatchPattern(pattern, entry.Key) {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", entry.Key, seconds(entry), entry.Size)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func export(e *env) error {
+	out := e.out
+	if len(e.args) > 0 {
+		f, err := os.Create(e.args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	_, err := cache.Export(e.c, out)
+	return err
+}
+
+func importEntries(e *env) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var opt cache.ImportOptions
+	fs.BoolVar(&opt.SkipExpired, "skip-expired", false, "")
+	fs.BoolVar(&opt.SkipExisting, "skip-existing", false, "")
+	if err := fs.Parse(e.args); err != nil {
+		return err
+	} else if fs.NArg() > 1 {
+		return errors.New("too many arguments")
+	}
+
+	in := e.in
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	res, err := cache.Import(e.c, in, opt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.out, "%d imported, %d expired, %d existing skipped\n", res.Imported, res.Expired, res.Existing)
+	return err
+}
+
+func usage(fs *flag.FlagSet, w io.Writer) func() {
+	return func() {
+		fmt.Fprintln(w, "Usage: macaron-cache [flags] <command> [arguments]")
+		fmt.Fprintln(w, "\nCommands:")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(w, "  "+commands[name].usage)
+		}
+		fmt.Fprintln(w, "\nFlags:")
+		fs.PrintDefaults()
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("macaron-cache", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		config        = fs.String("config", "", "path of app.ini to read options from")
+		section       = fs.String("section", "cache", "configuration section name")
+		adapter       = fs.String("adapter", "", "name of adapter, overrides ADAPTER")
+		adapterConfig = fs.String("adapter-config", "", "adapter configuration, overrides ADAPTER_CONFIG")
+		occupyMode    = fs.Bool("occupy", false, "occupy entire database")
+	)
+	fs.Usage = usage(fs, stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return 2
+	} else if n := fs.NArg() - 1; n < cmd.nargs[0] || n > cmd.nargs[1] {
+		fmt.Fprintln(stderr, "Usage: macaron-cache [flags] "+cmd.usage)
+		return 2
+	}
+
+	if len(*config) > 0 {
+		if _, err := macaron.SetConfig(*config); err != nil {
+			fmt.Fprintf(stderr, "macaron-cache: error loading config: %v\n", err)
+			return 1
+		}
+	}
+	opt := cache.PrepareOptions(cache.Options{
+		Adapter:       *adapter,
+		AdapterConfig: *adapterConfig,
+		// Garbage collection is left to the application.
+		Interval:   -1,
+		OccupyMode: *occupyMode,
+		Section:    *section,
+	})
+	c, err := cache.NewCacher(opt.Adapter, opt)
+	if err != nil {
+		fmt.Fprintf(stderr, "macaron-cache: error starting adapter '%s': %v\n", opt.Adapter, err)
+		return 1
+	}
+
+	if err = cmd.run(&env{
+		c:    c,
+		args: fs.Args()[1:],
+		in:   stdin,
+		out:  stdout,
+	}); err != nil {
+		fmt.Fprintf(stderr, "macaron-cache: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
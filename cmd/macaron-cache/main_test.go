@@ -0,0 +1,100 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Run(t *testing.T) {
+	Convey("Operate file cache", t, func() {
+		dir, err := ioutil.TempDir("", "macaron-cache")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		conf := filepath.Join(dir, "app.ini")
+		So(ioutil.WriteFile(conf, []byte("[cache]\nADAPTER = file\nADAPTER_CONFIG = "+filepath.Join(dir, "caches")+"\n"), 0644), ShouldBeNil)
+
+		exec := func(stdin string, args ...string) (int, string) {
+			var stdout, stderr bytes.Buffer
+			code := run(append([]string{"-config", conf}, args...), strings.NewReader(stdin), &stdout, &stderr)
+			return code, stdout.String() + stderr.String()
+		}
+
+		code, _ := exec("", "put", "user:1", "unknwon", "60")
+		So(code, ShouldEqual, 0)
+		code, out := exec("", "get", "user:1")
+		So(code, ShouldEqual, 0)
+		So(out, ShouldEqual, "unknwon\n")
+
+		code, out = exec("", "ttl", "user:1")
+		So(code, ShouldEqual, 0)
+		So(out, ShouldBeIn, "60\n", "59\n")
+
+		code, out = exec("", "incr", "counter", "5")
+		So(code, ShouldEqual, 0)
+		So(out, ShouldEqual, "5\n")
+
+		code, out = exec("", "scan", "user:*")
+		So(code, ShouldEqual, 0)
+		So(out, ShouldStartWith, "user:1\t")
+
+		export := filepath.Join(dir, "export.json")
+		code, _ = exec("", "export", export)
+		So(code, ShouldEqual, 0)
+
+		code, _ = exec("", "flush", "user:")
+		So(code, ShouldEqual, 0)
+		code, out = exec("", "get", "user:1")
+		So(code, ShouldEqual, 1)
+		So(out, ShouldContainSubstring, "not exist")
+
+		code, out = exec("", "import", "-skip-existing", export)
+		So(code, ShouldEqual, 0)
+		So(out, ShouldEqual, "1 imported, 0 expired, 1 existing skipped\n")
+		_, out = exec("", "get", "user:1")
+		So(out, ShouldEqual, "unknwon\n")
+
+		code, out = exec("", "import", "-skip-existing", export)
+		So(code, ShouldEqual, 0)
+		So(out, ShouldEqual, "0 imported, 0 expired, 2 existing skipped\n")
+
+		code, _ = exec("", "del", "user:1")
+		So(code, ShouldEqual, 0)
+		code, _ = exec("", "del", "user:1")
+		So(code, ShouldEqual, 1)
+
+		code, _ = exec("", "flush")
+		So(code, ShouldEqual, 0)
+		code, _ = exec("", "get", "counter")
+		So(code, ShouldEqual, 1)
+	})
+
+	Convey("Reject invalid usage", t, func() {
+		var stdout, stderr bytes.Buffer
+		So(run([]string{"-adapter", "memory", "unknown"}, nil, &stdout, &stderr), ShouldEqual, 2)
+		So(stderr.String(), ShouldContainSubstring, "Commands:")
+		So(run([]string{"-adapter", "memory", "get"}, nil, &stdout, &stderr), ShouldEqual, 2)
+		So(run([]string{"-adapter", "fake", "get", "key"}, nil, &stdout, &stderr), ShouldEqual, 1)
+		So(run([]string{"-adapter", "memory", "stats"}, nil, &stdout, &stderr), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"hash/crc32"
+	"sync"
+)
+
+// ErrCounterUnsupported is returned when incrementing a counter of an adapter
+// that does not implement Counter.
+var ErrCounterUnsupported = errors.New("cache: adapter does not support counters")
+
+// Counter is implemented by adapters that can atomically add to a counter
+// and create it with an expire time when it does not exist.
+type Counter interface {
+	// IncrBy adds delta to cached int-type value by given key and returns the result.
+	// A missing or expired key is created with value delta and given expire time.
+	IncrBy(key string, delta, expire int64) (int64, error)
+}
+
+// keyLocks serializes read-modify-write operations on the same key within the process.
+type keyLocks [64]sync.Mutex
+
+func (l *keyLocks) get(key string) *sync.Mutex {
+	return &l[crc32.ChecksumIEEE([]byte(key))%uint32(len(l))]
+}
+
+// Increment adds delta to cached int-type value by given key and returns the result.
+// A missing key is created with value delta and given expire time. It returns
+// ErrCounterUnsupported if the adapter does not implement Counter.
+func Increment(c Cache, key string, delta, expire int64) (int64, error) {
+	counter, ok := c.(Counter)
+	if !ok {
+		return 0, ErrCounterUnsupported
+	}
+	return counter.IncrBy(key, delta, expire)
+}
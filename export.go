@@ -0,0 +1,282 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/unknwon/com"
+)
+
+const (
+	// ExportFormat is the name of the format written by Export.
+	ExportFormat = "macaron-cache"
+	// ExportVersion is the version of the format written by Export.
+	ExportVersion = 1
+)
+
+// Codecs of exported values.
+const (
+	CodecString = "string" // Value is a string.
+	CodecBytes  = "bytes"  // Value is a []byte.
+	CodecGob    = "gob"    // Value is an Item encoded by EncodeGob.
+)
+
+// exportHeader is the first line of an export.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Unix time of the export.
+	Time int64 `json:"time"`
+}
+
+// exportRecord is a line of an export following the header.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Codec string `json:"codec"`
+	Value []byte `json:"value"`
+	// Remaining seconds before the value expires at the export time, 0 if it does not expire.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// encodeValue encodes val with the most specific codec, values that
+// cannot be encoded by gob are exported as strings.
+func encodeValue(val interface{}) (string, []byte) {
+	switch val := val.(type) {
+	case string:
+		return CodecString, []byte(val)
+	case []byte:
+		return CodecBytes, val
+	case gobValue:
+		return CodecGob, val
+	}
+	if data, err := EncodeGob(&Item{Val: val}); err == nil {
+		return CodecGob, data
+	}
+	return CodecString, []byte(com.ToStr(val))
+}
+
+func decodeValue(codec string, data []byte) (interface{}, error) {
+	switch codec {
+	case CodecString:
+		return string(data), nil
+	case CodecBytes:
+		return data, nil
+	case CodecGob:
+		item := new(Item)
+		if err := DecodeGob(data, item); err != nil {
+			return nil, err
+		}
+		return item.Val, nil
+	}
+	return nil, fmt.Errorf("unsupported codec '%s'", codec)
+}
+
+// exporter writes values in the format of Export.
+type exporter struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+// newExporter writes the header of an export made at given time.
+func newExporter(w io.Writer, now time.Time) (*exporter, error) {
+	bw := bufio.NewWriter(w)
+	ex := &exporter{
+		bw:  bw,
+		enc: json.NewEncoder(bw),
+	}
+	return ex, ex.enc.Encode(exportHeader{
+		Format:  ExportFormat,
+		Version: ExportVersion,
+		Time:    now.Unix(),
+	})
+}
+
+// write writes a value with its remaining TTL in seconds, 0 if it does not expire.
+func (ex *exporter) write(key string, val interface{}, ttl int64) error {
+	r := exportRecord{
+		Key: key,
+		TTL: ttl,
+	}
+	r.Codec, r.Value = encodeValue(val)
+	return ex.enc.Encode(r)
+}
+
+func (ex *exporter) flush() error {
+	return ex.bw.Flush()
+}
+
+// Export writes all live values of the cache to w as a stream of JSON lines,
+// starting with a header that describes the format and version, followed
+// by the key, codec, encoded value and remaining TTL of every value.
+// It requires the adapter to implement Scanner and returns the number of exported values.
+func Export(c Cache, w io.Writer) (int, error) {
+	scanner, ok := c.(Scanner)
+	if !ok {
+		return 0, ErrScanUnsupported
+	}
+
+	// Collect entries first so the adapter is not called back while scanning.
+	var entries []Entry
+	if err := scanner.Scan(func(e Entry) bool {
+		entries = append(entries, e)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	ex, err := newExporter(w, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		val := c.Get(e.Key)
+		if val == nil {
+			continue
+		}
+
+		var ttl int64
+		if !e.Expires.IsZero() {
+			// Round up so that values about to expire are still exported with a TTL.
+			ttl = int64((e.TTL(now) + time.Second - 1) / time.Second)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		if err = ex.write(e.Key, val, ttl); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, ex.flush()
+}
+
+// ImportOptions represents a struct for specifying configuration options for Import.
+type ImportOptions struct {
+	// Skip values that have expired since the export, and count remaining TTL of
+	// others from the export time. Default restores the TTL values had at the export time.
+	SkipExpired bool
+	// Skip values whose key already exists in the cache instead of overwriting them.
+	SkipExisting bool
+	// Clock used to compute remaining TTL. Default is DefaultClock.
+	Clock Clock
+}
+
+// ImportResult represents numbers of imported and skipped values.
+type ImportResult struct {
+	Imported int
+	Expired  int
+	Existing int
+}
+
+// importer reads values written by Export.
+type importer struct {
+	dec    *json.Decoder
+	header exportHeader
+}
+
+func newImporter(r io.Reader) (*importer, error) {
+	im := &importer{dec: json.NewDecoder(bufio.NewReader(r))}
+	if err := im.dec.Decode(&im.header); err != nil {
+		return nil, fmt.Errorf("cache: error reading export header: %v", err)
+	} else if im.header.Format != ExportFormat {
+		return nil, fmt.Errorf("cache: unknown export format '%s'", im.header.Format)
+	} else if im.header.Version < 1 || im.header.Version > ExportVersion {
+		return nil, fmt.Errorf("cache: unsupported export version %d", im.header.Version)
+	}
+	return im, nil
+}
+
+// next returns the next record, or io.EOF at the end of the export.
+func (im *importer) next() (*exportRecord, error) {
+	rec := new(exportRecord)
+	if err := im.dec.Decode(rec); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("cache: error reading export: %v", err)
+	}
+	return rec, nil
+}
+
+// expire returns the expire time to put the record with. If skipExpired is true,
+// remaining TTL is counted from the export time and false is returned if the record has expired.
+func (im *importer) expire(rec *exportRecord, skipExpired bool, now time.Time) (int64, bool) {
+	if !skipExpired || rec.TTL <= 0 {
+		return rec.TTL, true
+	}
+	expire := im.header.Time + rec.TTL - now.Unix()
+	return expire, expire > 0
+}
+
+// put decodes the record and puts it into the cache.
+func (im *importer) put(c Cache, rec *exportRecord, expire int64) error {
+	val, err := decodeValue(rec.Codec, rec.Value)
+	if err != nil {
+		return fmt.Errorf("cache: error decoding value of '%s': %v", rec.Key, err)
+	}
+	if err = c.Put(rec.Key, val, expire); err != nil {
+		return fmt.Errorf("cache: error importing '%s': %v", rec.Key, err)
+	}
+	return nil
+}
+
+// Import reads values written by Export from r and puts them into the cache.
+// An single variadic cache.ImportOptions struct can be optionally provided to configure.
+func Import(c Cache, r io.Reader, options ...ImportOptions) (*ImportResult, error) {
+	var opt ImportOptions
+	if len(options) > 0 {
+		opt = options[0]
+	}
+	if opt.Clock == nil {
+		opt.Clock = DefaultClock
+	}
+
+	im, err := newImporter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(ImportResult)
+	for {
+		rec, err := im.next()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+
+		expire, ok := im.expire(rec, opt.SkipExpired, opt.Clock.Now())
+		if !ok {
+			res.Expired++
+			continue
+		}
+		if opt.SkipExisting && c.IsExist(rec.Key) {
+			res.Existing++
+			continue
+		}
+
+		if err = im.put(c, rec, expire); err != nil {
+			return res, err
+		}
+		res.Imported++
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ExportImport(t *testing.T) {
+	Convey("Migrate from memory to file adapter", t, func() {
+		src := NewMemoryCacher()
+		So(src.StartAndGC(Options{}), ShouldBeNil)
+		So(src.Put("string", "unknwon", 0), ShouldBeNil)
+		So(src.Put("bytes", []byte("macaron"), 0), ShouldBeNil)
+		So(src.Put("int64", int64(42), 60), ShouldBeNil)
+
+		var buf bytes.Buffer
+		n, err := Export(src, &buf)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		So(buf.String(), ShouldStartWith, `{"format":"macaron-cache","version":1,`)
+
+		dir := path.Join(os.TempDir(), "data/import")
+		os.RemoveAll(dir)
+		dst := NewFileCacher()
+		So(dst.StartAndGC(Options{AdapterConfig: dir}), ShouldBeNil)
+		So(dst.Put("string", "existing", 0), ShouldBeNil)
+
+		res, err := Import(dst, bytes.NewReader(buf.Bytes()), ImportOptions{SkipExisting: true})
+		So(err, ShouldBeNil)
+		So(*res, ShouldResemble, ImportResult{Imported: 2, Existing: 1})
+		So(dst.Get("string"), ShouldEqual, "existing")
+		So(dst.Get("bytes"), ShouldResemble, []byte("macaron"))
+		So(dst.Get("int64"), ShouldEqual, 42)
+		e, ok := dst.Inspect("int64")
+		So(ok, ShouldBeTrue)
+		So(e.TTL(time.Now()), ShouldBeBetweenOrEqual, 59*time.Second, 60*time.Second)
+
+		res, err = Import(dst, bytes.NewReader(buf.Bytes()))
+		So(err, ShouldBeNil)
+		So(res.Imported, ShouldEqual, 3)
+		So(dst.Get("string"), ShouldEqual, "unknwon")
+	})
+
+	Convey("Skip values expired since the export", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{Clock: clock}), ShouldBeNil)
+
+		export := `{"format":"macaron-cache","version":1,"time":999999990}
+{"key":"expired","codec":"string","value":"dW5rbndvbg==","ttl":5}
+{"key":"alive","codec":"string","value":"dW5rbndvbg==","ttl":20}
+{"key":"forever","codec":"string","value":"dW5rbndvbg=="}
+`
+		res, err := Import(c, strings.NewReader(export), ImportOptions{SkipExpired: true, Clock: clock})
+		So(err, ShouldBeNil)
+		So(*res, ShouldResemble, ImportResult{Imported: 2, Expired: 1})
+		So(c.Get("expired"), ShouldBeNil)
+		e, ok := c.Inspect("alive")
+		So(ok, ShouldBeTrue)
+		So(e.TTL(clock.Now()), ShouldEqual, 10*time.Second)
+		So(c.Get("forever"), ShouldEqual, "unknwon")
+
+		res, err = Import(c, strings.NewReader(export), ImportOptions{Clock: clock})
+		So(err, ShouldBeNil)
+		So(res.Imported, ShouldEqual, 3)
+		So(c.Get("expired"), ShouldEqual, "unknwon")
+	})
+
+	Convey("Reject unknown formats", t, func() {
+		c := NewMemoryCacher()
+		_, err := Import(c, strings.NewReader(`{"format":"other","version":1}`))
+		So(err, ShouldNotBeNil)
+		_, err = Import(c, strings.NewReader(`{"format":"macaron-cache","version":2}`))
+		So(err, ShouldNotBeNil)
+		_, err = Import(c, strings.NewReader(`{"format":"macaron-cache","version":1}
+{"key":"k","codec":"xml","value":""}`))
+		So(err, ShouldNotBeNil)
+
+		_, err = Export(NewNullCacher(false), &bytes.Buffer{})
+		So(err, ShouldEqual, ErrScanUnsupported)
+	})
+}
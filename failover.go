@@ -0,0 +1,437 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultFailoverTimeout is the default time to wait for a replica to respond.
+	DefaultFailoverTimeout = time.Second
+	// DefaultProbeInterval is the default interval of replica health probing.
+	DefaultProbeInterval = 5 * time.Second
+
+	// readCheckInterval is the minimal interval between health checks
+	// of the same replica that are triggered by read misses.
+	readCheckInterval = time.Second
+)
+
+var (
+	ErrNoReplica      = errors.New("cache/failover: no replica available")
+	ErrReplicaTimeout = errors.New("cache/failover: replica timed out")
+)
+
+type replica struct {
+	checked  int64 // Unix nanoseconds of the last check, accessed atomically.
+	name     string
+	cache    Cache
+	opt      Options
+	started  bool  // Only accessed by the goroutine holding checking.
+	healthy  int32 // Accessed atomically.
+	checking int32 // Accessed atomically.
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// setHealthy updates health status of the replica and logs the change if any.
+func (r *replica) setHealthy(healthy bool, reason error) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&r.healthy, v) == v {
+		return
+	}
+	if healthy {
+		log.Printf("cache/failover: replica '%s' is back in service", r.name)
+	} else {
+		log.Printf("cache/failover: replica '%s' is out of service: %v", r.name, reason)
+	}
+}
+
+// FailoverCacher represents a cache adapter that replicates writes to a primary
+// and its secondary cachers, and reads from the first healthy one of them.
+type FailoverCacher struct {
+	lock          sync.RWMutex
+	replicas      []*replica
+	timeout       time.Duration
+	probeInterval time.Duration
+	clock         Clock
+	probing       bool // True once health probing has been scheduled.
+}
+
+// NewFailoverCacher creates and returns a new failover cacher. Non-positive
+// timeout disables the per-call timeout, and non-positive probe interval
+// disables background health probing.
+func NewFailoverCacher(timeout, probeInterval time.Duration) *FailoverCacher {
+	return &FailoverCacher{
+		timeout:       timeout,
+		probeInterval: probeInterval,
+		clock:         DefaultClock,
+	}
+}
+
+// AddReplica appends a started cacher with given name as a replica,
+// the first replica added is the primary.
+func (c *FailoverCacher) AddReplica(name string, r Cache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.replicas = append(c.replicas, &replica{
+		name:    name,
+		cache:   r,
+		started: true,
+		healthy: 1,
+	})
+}
+
+func (c *FailoverCacher) now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.clock.Now()
+}
+
+// available returns healthy replicas in priority order.
+func (c *FailoverCacher) available() []*replica {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	replicas := make([]*replica, 0, len(c.replicas))
+	for _, r := range c.replicas {
+		if r.isHealthy() {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas
+}
+
+// call invokes fn on the replica and takes it out of service if the call times out.
+func (c *FailoverCacher) call(r *replica, fn func(Cache) (interface{}, error)) (interface{}, error) {
+	if c.timeout <= 0 {
+		return fn(r.cache)
+	}
+
+	type result struct {
+		val interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := fn(r.cache)
+		done <- result{val, err}
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.val, res.err
+	case <-timer.C:
+		r.setHealthy(false, ErrReplicaTimeout)
+		return nil, ErrReplicaTimeout
+	}
+}
+
+// write fans out fn to all healthy replicas, it succeeds if any of them
+// accepts the write, and returns the error of the one with highest priority
+// that responded in time otherwise. Replicas that fail are checked before
+// it returns, so that the next calls skip them if they are unreachable.
+func (c *FailoverCacher) write(fn func(Cache) error) error {
+	_, err := c.update(func(r Cache) (interface{}, error) {
+		return nil, fn(r)
+	})
+	return err
+}
+
+// update is like write, and also returns the value returned by
+// the replica with highest priority that accepted the write.
+func (c *FailoverCacher) update(call func(Cache) (interface{}, error)) (interface{}, error) {
+	replicas := c.available()
+	if len(replicas) == 0 {
+		return nil, ErrNoReplica
+	}
+
+	var wg sync.WaitGroup
+	vals := make([]interface{}, len(replicas))
+	errs := make([]error, len(replicas))
+	for i := range replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vals[i], errs[i] = c.call(replicas[i], call)
+			if errs[i] != nil && errs[i] != ErrReplicaTimeout {
+				// The error may be a legitimate one (e.g. key not exist),
+				// only a probe can tell whether the replica is still reachable.
+				c.check(replicas[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			return vals[i], nil
+		}
+	}
+	for _, err := range errs {
+		if err != ErrReplicaTimeout {
+			return nil, err
+		}
+	}
+	return nil, ErrNoReplica
+}
+
+// read calls fn on healthy replicas in priority order until one responds in time
+// with a value. As adapters report errors of reads as misses, a replica that
+// misses is rechecked, and the next one is tried if it is unreachable.
+func (c *FailoverCacher) read(fn func(Cache) interface{}) interface{} {
+	call := func(r Cache) (interface{}, error) {
+		return fn(r), nil
+	}
+	replicas := c.available()
+	for i, r := range replicas {
+		val, err := c.call(r, call)
+		if err == ErrReplicaTimeout {
+			continue
+		} else if val != nil || i == len(replicas)-1 || c.recheck(r) {
+			return val
+		}
+	}
+	return nil
+}
+
+// Put puts value into cache with key and expire time.
+func (c *FailoverCacher) Put(key string, val interface{}, expire int64) error {
+	return c.write(func(r Cache) error {
+		return r.Put(key, val, expire)
+	})
+}
+
+// Get gets cached value by given key.
+func (c *FailoverCacher) Get(key string) interface{} {
+	return c.read(func(r Cache) interface{} {
+		return r.Get(key)
+	})
+}
+
+// Delete deletes cached value by given key.
+func (c *FailoverCacher) Delete(key string) error {
+	return c.write(func(r Cache) error {
+		return r.Delete(key)
+	})
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *FailoverCacher) Incr(key string) error {
+	return c.write(func(r Cache) error {
+		return r.Incr(key)
+	})
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (c *FailoverCacher) Decr(key string) error {
+	return c.write(func(r Cache) error {
+		return r.Decr(key)
+	})
+}
+
+// IncrBy adds delta to the counter of given key in every healthy replica, and
+// returns the result of the one with highest priority. It returns
+// ErrCounterUnsupported if any replica does not implement Counter.
+func (c *FailoverCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	c.lock.RLock()
+	for _, r := range c.replicas {
+		if _, ok := r.cache.(Counter); !ok {
+			c.lock.RUnlock()
+			return 0, ErrCounterUnsupported
+		}
+	}
+	c.lock.RUnlock()
+
+	n, err := c.update(func(r Cache) (interface{}, error) {
+		return r.(Counter).IncrBy(key, delta, expire)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.(int64), nil
+}
+
+// IsExist returns true if cached value exists.
+func (c *FailoverCacher) IsExist(key string) bool {
+	return c.read(func(r Cache) interface{} {
+		if r.IsExist(key) {
+			return true
+		}
+		return nil
+	}) != nil
+}
+
+// Flush deletes all cached data.
+func (c *FailoverCacher) Flush() error {
+	return c.write(func(r Cache) error {
+		return r.Flush()
+	})
+}
+
+func ping(c Cache) (interface{}, error) {
+	if p, ok := c.(Pinger); ok {
+		return nil, p.Ping()
+	}
+	if err := c.Put("macaron_cache_ping", "1", 1); err != nil {
+		return nil, err
+	}
+	return nil, c.Delete("macaron_cache_ping")
+}
+
+func flush(c Cache) (interface{}, error) {
+	return nil, c.Flush()
+}
+
+// check starts the replica if it has not been yet, probes its health and
+// returns true if it is healthy. Concurrent checks of the same replica
+// are skipped and report its current status. A replica that comes back
+// is flushed before it is put in service, as it has missed writes
+// while it was out of service.
+func (c *FailoverCacher) check(r *replica) bool {
+	if !atomic.CompareAndSwapInt32(&r.checking, 0, 1) {
+		return r.isHealthy()
+	}
+	defer atomic.StoreInt32(&r.checking, 0)
+	atomic.StoreInt64(&r.checked, c.now().UnixNano())
+
+	if !r.started {
+		if err := r.cache.StartAndGC(r.opt); err != nil {
+			r.setHealthy(false, err)
+			return false
+		}
+		r.started = true
+	}
+
+	if _, err := c.call(r, ping); err != nil {
+		r.setHealthy(false, err)
+		return false
+	}
+	if !r.isHealthy() {
+		if _, err := c.call(r, flush); err != nil {
+			log.Printf("cache/failover: error flushing replica '%s': %v", r.name, err)
+			return false
+		}
+	}
+	r.setHealthy(true, nil)
+	return true
+}
+
+// recheck checks the replica unless it has been checked recently, in which
+// case its current status is reported, so that misses, which are common,
+// do not probe the replica on every read.
+func (c *FailoverCacher) recheck(r *replica) bool {
+	last := atomic.LoadInt64(&r.checked)
+	if c.now().UnixNano()-last < int64(readCheckInterval) {
+		return r.isHealthy()
+	}
+	return c.check(r)
+}
+
+func (c *FailoverCacher) startProbe() {
+	c.lock.RLock()
+	replicas, interval, clock := c.replicas, c.probeInterval, c.clock
+	c.lock.RUnlock()
+	for _, r := range replicas {
+		c.check(r)
+	}
+
+	clock.AfterFunc(interval, func() { c.startProbe() })
+}
+
+// scheduleProbe starts health probing of replicas unless it is disabled
+// or has already been started. It must be called with the lock held.
+func (c *FailoverCacher) scheduleProbe() {
+	if c.probeInterval <= 0 || c.probing {
+		return
+	}
+	c.probing = true
+	c.clock.AfterFunc(c.probeInterval, func() { c.startProbe() })
+}
+
+// StartAndGC starts every replica based on config string settings.
+// Replicas are separated by semicolons, each one in form of "<adapter>:<adapter config>",
+// the first one is the primary. Replicas that fail to start are retried by health probing.
+// AdapterConfig: redis:addr=:6379,prefix=cache:;memory
+func (c *FailoverCacher) StartAndGC(opt Options) error {
+	var (
+		replicas []*replica
+		started  int
+	)
+	for _, def := range strings.Split(opt.AdapterConfig, ";") {
+		def = strings.TrimSpace(def)
+		if len(def) == 0 {
+			continue
+		}
+
+		child, childOpt, err := childAdapter(def, opt)
+		if err != nil {
+			return err
+		}
+		r := &replica{
+			name:  def,
+			cache: child,
+			opt:   childOpt,
+		}
+		if err = child.StartAndGC(childOpt); err != nil {
+			log.Printf("cache/failover: error starting replica '%s': %v", def, err)
+		} else {
+			r.started = true
+			r.healthy = 1
+			started++
+		}
+		replicas = append(replicas, r)
+	}
+
+	if len(replicas) == 0 {
+		return errors.New("cache/failover: no replicas configured")
+	} else if started == 0 {
+		return fmt.Errorf("cache/failover: none of %d replicas could be started", len(replicas))
+	}
+
+	c.lock.Lock()
+	c.replicas = replicas
+	// Instances created as children of another composite adapter have no settings.
+	if c.timeout == 0 && c.probeInterval == 0 {
+		c.timeout = DefaultFailoverTimeout
+		c.probeInterval = DefaultProbeInterval
+	}
+	if opt.Clock != nil {
+		c.clock = opt.Clock
+	} else if c.clock == nil {
+		c.clock = DefaultClock
+	}
+	c.scheduleProbe()
+	c.lock.Unlock()
+	return nil
+}
+
+func init() {
+	Register("failover", NewFailoverCacher(DefaultFailoverTimeout, DefaultProbeInterval))
+}
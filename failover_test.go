@@ -0,0 +1,166 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// flakyCacher wraps a memory cacher that can be taken down or slowed down.
+type flakyCacher struct {
+	*MemoryCacher
+	down  int32
+	slow  int32
+	pings int32
+}
+
+// errFlakyDown looks like a network error, as adapters would return.
+var errFlakyDown = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("flaky cacher is down")}
+
+func newFlakyCacher() *flakyCacher {
+	return &flakyCacher{MemoryCacher: NewMemoryCacher()}
+}
+
+func (c *flakyCacher) wait() error {
+	if atomic.LoadInt32(&c.slow) == 1 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&c.down) == 1 {
+		return errFlakyDown
+	}
+	return nil
+}
+
+func (c *flakyCacher) Put(key string, val interface{}, expire int64) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.MemoryCacher.Put(key, val, expire)
+}
+
+func (c *flakyCacher) Get(key string) interface{} {
+	if c.wait() != nil {
+		return nil
+	}
+	return c.MemoryCacher.Get(key)
+}
+
+func (c *flakyCacher) Ping() error {
+	atomic.AddInt32(&c.pings, 1)
+	return c.wait()
+}
+
+func Test_FailoverCacher(t *testing.T) {
+	Convey("Test failover cache adapter", t, func() {
+		dir := path.Join(os.TempDir(), "data/failover")
+		os.RemoveAll(dir)
+		testAdapter(Options{
+			Adapter:       "failover",
+			AdapterConfig: "memory;file:" + dir,
+			Interval:      2,
+		})
+	})
+
+	Convey("Start with unavailable replicas", t, func() {
+		c := NewFailoverCacher(DefaultFailoverTimeout, 0)
+		So(c.StartAndGC(Options{AdapterConfig: ""}), ShouldNotBeNil)
+		So(c.StartAndGC(Options{AdapterConfig: "fake"}), ShouldNotBeNil)
+		So(c.StartAndGC(Options{AdapterConfig: "file:" + os.DevNull + "/data;memory"}), ShouldBeNil)
+		So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+		So(c.Get("uname"), ShouldEqual, "unknwon")
+	})
+
+	Convey("Fall back to secondary and recover primary", t, func() {
+		primary, secondary := newFlakyCacher(), newFlakyCacher()
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewFailoverCacher(50*time.Millisecond, time.Second)
+		c.AddReplica("primary", primary)
+		c.AddReplica("secondary", secondary)
+		c.lock.Lock()
+		c.clock = clock
+		c.scheduleProbe()
+		c.lock.Unlock()
+
+		So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+		So(primary.MemoryCacher.Get("uname"), ShouldEqual, "unknwon")
+		So(secondary.MemoryCacher.Get("uname"), ShouldEqual, "unknwon")
+
+		primaryHealthy := func() bool {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+			return c.replicas[0].isHealthy()
+		}
+
+		Convey("Primary errors on write", func() {
+			atomic.StoreInt32(&primary.down, 1)
+			So(c.Put("uname", "unknwon2", 0), ShouldBeNil)
+			So(primaryHealthy(), ShouldBeFalse)
+			So(c.Get("uname"), ShouldEqual, "unknwon2")
+
+			atomic.StoreInt32(&primary.down, 0)
+			clock.Advance(time.Second)
+			So(primaryHealthy(), ShouldBeTrue)
+
+			// The recovered primary must not serve the value it missed the update of.
+			So(primary.MemoryCacher.IsExist("uname"), ShouldBeFalse)
+			So(c.Get("uname"), ShouldBeNil)
+			So(c.Put("uname", "unknwon3", 0), ShouldBeNil)
+			So(c.Get("uname"), ShouldEqual, "unknwon3")
+		})
+
+		Convey("Primary errors on read", func() {
+			atomic.StoreInt32(&primary.down, 1)
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+			So(primaryHealthy(), ShouldBeFalse)
+			So(c.IsExist("uname"), ShouldBeTrue)
+		})
+
+		Convey("Primary misses", func() {
+			So(secondary.MemoryCacher.Put("other", "value", 0), ShouldBeNil)
+			So(c.Get("other"), ShouldBeNil)
+			So(primaryHealthy(), ShouldBeTrue)
+			So(atomic.LoadInt32(&primary.pings), ShouldEqual, 1)
+
+			// Misses check the primary at most once per interval.
+			So(c.Get("other"), ShouldBeNil)
+			So(atomic.LoadInt32(&primary.pings), ShouldEqual, 1)
+		})
+
+		Convey("Primary times out", func() {
+			atomic.StoreInt32(&primary.slow, 1)
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+			So(primaryHealthy(), ShouldBeFalse)
+
+			atomic.StoreInt32(&primary.slow, 0)
+			clock.Advance(time.Second)
+			So(primaryHealthy(), ShouldBeTrue)
+		})
+
+		Convey("All replicas are down", func() {
+			atomic.StoreInt32(&primary.slow, 1)
+			atomic.StoreInt32(&secondary.slow, 1)
+			So(c.Get("uname"), ShouldBeNil)
+			So(c.Put("uname", "unknwon", 0), ShouldEqual, ErrNoReplica)
+		})
+	})
+}
@@ -18,15 +18,16 @@ package cache
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"fmt"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/unknwon/com"
 	"gopkg.in/macaron.v1"
 )
 
@@ -35,23 +36,37 @@ type Item struct {
 	Val     interface{}
 	Created int64
 	Expire  int64
+	// Original key of the item, kept by adapters that store hashed keys.
+	Key string
 }
 
-func (item *Item) hasExpired() bool {
+func (item *Item) hasExpired(now time.Time) bool {
 	return item.Expire > 0 &&
-		(time.Now().Unix()-item.Created) >= item.Expire
+		(now.Unix()-item.Created) >= item.Expire
 }
 
+const (
+	// Directory under the root corrupt files are moved to by GC.
+	fileQuarantineDir = "quarantine"
+	// Age after which temporary files left behind by crashed writes are deleted by GC.
+	fileTempMaxAge = time.Hour
+)
+
 // FileCacher represents a file cache adapter implementation.
+// Files are replaced atomically, so that readers never see partial writes,
+// and counters are updated under a lock file shared with other processes.
 type FileCacher struct {
 	lock     sync.Mutex
 	rootPath string
-	interval int // GC interval.
+	interval int  // GC interval.
+	sync     bool // Fsync files before renaming them into place.
+	clock    Clock
+	locks    keyLocks // Serializes counter updates within the process.
 }
 
 // NewFileCacher creates and returns a new file cacher.
 func NewFileCacher() *FileCacher {
-	return &FileCacher{}
+	return &FileCacher{clock: DefaultClock}
 }
 
 func (c *FileCacher) filepath(key string) string {
@@ -63,18 +78,43 @@ func (c *FileCacher) filepath(key string) string {
 // Put puts value into cache with key and expire time.
 // If expired is 0, it will not be deleted by GC.
 func (c *FileCacher) Put(key string, val interface{}, expire int64) error {
-	filename := c.filepath(key)
-	item := &Item{val, time.Now().Unix(), expire}
+	return c.write(&Item{
+		Val:     val,
+		Created: c.clock.Now().Unix(),
+		Expire:  expire,
+		Key:     key,
+	})
+}
+
+// write stores given item in the file of its key.
+func (c *FileCacher) write(item *Item) error {
 	data, err := EncodeGob(item)
 	if err != nil {
 		return err
 	}
+	return writeFileAtomic(c.filepath(item.Key), c.sync, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
 
-	err = os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+// lockKey acquires the lock of given key, which is also held
+// against other processes sharing the directory. Lock files are
+// deleted by GC once the files of their keys are gone.
+func (c *FileCacher) lockKey(key string) (func(), error) {
+	lock := c.locks.get(key)
+	lock.Lock()
+	unlock, err := lockFile(c.filepath(key) + ".lock")
 	if err != nil {
-		return err
+		lock.Unlock()
+		return nil, err
 	}
-	return ioutil.WriteFile(filename, data, os.ModePerm)
+	return func() {
+		if err := unlock(); err != nil {
+			log.Printf("cache/file: error unlocking '%s': %v", key, err)
+		}
+		lock.Unlock()
+	}, nil
 }
 
 func (c *FileCacher) read(key string) (*Item, error) {
@@ -96,8 +136,8 @@ func (c *FileCacher) Get(key string) interface{} {
 		return nil
 	}
 
-	if item.hasExpired() {
-		os.Remove(c.filepath(key))
+	if item.hasExpired(c.clock.Now()) {
+		// The file is left to GC, as it may be replaced by Put meanwhile.
 		return nil
 	}
 	return item.Val
@@ -110,6 +150,12 @@ func (c *FileCacher) Delete(key string) error {
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *FileCacher) Incr(key string) error {
+	unlock, err := c.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	item, err := c.read(key)
 	if err != nil {
 		return err
@@ -125,6 +171,12 @@ func (c *FileCacher) Incr(key string) error {
 
 // Decrease cached int value.
 func (c *FileCacher) Decr(key string) error {
+	unlock, err := c.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	item, err := c.read(key)
 	if err != nil {
 		return err
@@ -138,9 +190,87 @@ func (c *FileCacher) Decr(key string) error {
 	return c.Put(key, item.Val, item.Expire)
 }
 
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *FileCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	unlock, err := c.lockKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	item, err := c.read(key)
+	if err != nil || item.hasExpired(c.clock.Now()) {
+		return delta, c.Put(key, delta, expire)
+	}
+
+	val, err := IncrBy(item.Val, delta)
+	if err != nil {
+		return 0, err
+	}
+	item.Val = val
+	item.Key = key
+	if err = c.write(item); err != nil {
+		return 0, err
+	}
+	return ToInt64(val)
+}
+
 // IsExist returns true if cached value exists.
 func (c *FileCacher) IsExist(key string) bool {
-	return com.IsExist(c.filepath(key))
+	item, err := c.read(key)
+	return err == nil && !item.hasExpired(c.clock.Now())
+}
+
+// Inspect describes cached value by given key, it returns false if the value does not exist.
+func (c *FileCacher) Inspect(key string) (Entry, bool) {
+	data, err := ioutil.ReadFile(c.filepath(key))
+	if err != nil {
+		return Entry{}, false
+	}
+	item := new(Item)
+	if err = DecodeGob(data, item); err != nil || item.hasExpired(c.clock.Now()) {
+		return Entry{}, false
+	}
+	return NewEntry(key, int64(len(data)), item.Created, item.Expire), true
+}
+
+// errStopScan stops walking the files when the scan function returns false.
+var errStopScan = errors.New("stop scan")
+
+// Scan calls fn with every cached value in no particular order until fn returns false.
+func (c *FileCacher) Scan(fn func(Entry) bool) error {
+	now := c.clock.Now()
+	err := filepath.Walk(c.rootPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if skip, err := c.skipFile(path, fi); skip {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		item := new(Item)
+		if DecodeGob(data, item) != nil || len(item.Key) == 0 || item.hasExpired(now) {
+			return nil
+		}
+		if !fn(NewEntry(item.Key, int64(len(data)), item.Created, item.Expire)) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
 }
 
 // Flush deletes all cached data.
@@ -156,27 +286,38 @@ func (c *FileCacher) startGC() {
 		return
 	}
 
+	// Errors are logged and the walk continues, so that a single
+	// bad file does not stop the others from being collected.
 	if err := filepath.Walk(c.rootPath, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("Walk: %v", err)
-		}
-
-		if fi.IsDir() {
+			if !os.IsNotExist(err) {
+				log.Printf("error garbage collecting cache files: Walk: %v", err)
+			}
 			return nil
+		} else if skip, err := c.skipFile(path, fi); skip {
+			if err == nil && isTempFile(path) && time.Since(fi.ModTime()) > fileTempMaxAge {
+				// Left behind by a crashed write.
+				os.Remove(path)
+			} else if err == nil && isLockFile(path) {
+				c.removeLock(path)
+			}
+			return err
 		}
 
 		data, err := ioutil.ReadFile(path)
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("ReadFile: %v", err)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("error garbage collecting cache files: ReadFile: %v", err)
+			}
+			return nil
 		}
 
 		item := new(Item)
 		if err = DecodeGob(data, item); err != nil {
-			return err
-		}
-		if item.hasExpired() {
+			c.quarantine(path, err)
+		} else if item.hasExpired(c.clock.Now()) {
 			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("Remove: %v", err)
+				log.Printf("error garbage collecting cache files: Remove: %v", err)
 			}
 		}
 		return nil
@@ -184,7 +325,73 @@ func (c *FileCacher) startGC() {
 		log.Printf("error garbage collecting cache files: %v", err)
 	}
 
-	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+	c.clock.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+}
+
+// skipFile returns true if given file does not hold an item, with filepath.SkipDir
+// for the quarantine. Files of items are named by hash of their keys, while
+// names of temporary and lock files have an extension.
+func (c *FileCacher) skipFile(path string, fi os.FileInfo) (bool, error) {
+	if fi.IsDir() {
+		if path == filepath.Join(c.rootPath, fileQuarantineDir) {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+	return strings.Contains(fi.Name(), "."), nil
+}
+
+// isTempFile returns true if given file is being written by writeFileAtomic.
+func isTempFile(path string) bool {
+	return strings.Contains(filepath.Base(path), ".tmp")
+}
+
+// isLockFile returns true if given file is the lock file of a key.
+func isLockFile(path string) bool {
+	return strings.HasSuffix(path, ".lock")
+}
+
+// removeLock deletes the lock file once the file of its key is gone
+// and it is not locked, so that lock files do not pile up.
+func (c *FileCacher) removeLock(path string) {
+	if _, err := os.Stat(strings.TrimSuffix(path, ".lock")); !os.IsNotExist(err) {
+		return
+	}
+	if err := removeLockFile(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("error garbage collecting cache files: removing lock: %v", err)
+	}
+}
+
+// quarantine moves the corrupt file out of the way of readers and GC,
+// keeping it to be inspected.
+func (c *FileCacher) quarantine(path string, reason error) {
+	// The file may have been replaced since it was read.
+	if data, err := ioutil.ReadFile(path); err != nil || DecodeGob(data, new(Item)) == nil {
+		return
+	}
+
+	log.Printf("cache/file: quarantining corrupt file '%s': %v", path, reason)
+	dir := filepath.Join(c.rootPath, fileQuarantineDir)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err == nil {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cache/file: error quarantining '%s': %v", path, err)
+	}
+}
+
+// stopGC stops the GC routine after its current pass.
+func (c *FileCacher) stopGC() {
+	c.lock.Lock()
+	c.interval = 0
+	c.lock.Unlock()
+}
+
+// Close stops the GC routine, cached files are kept.
+func (c *FileCacher) Close() error {
+	c.stopGC()
+	return nil
 }
 
 // StartAndGC starts GC routine based on config string settings.
@@ -192,6 +399,12 @@ func (c *FileCacher) StartAndGC(opt Options) error {
 	c.lock.Lock()
 	c.rootPath = opt.AdapterConfig
 	c.interval = opt.Interval
+	c.sync = opt.FileSync
+	if opt.Clock != nil {
+		c.clock = opt.Clock
+	} else if c.clock == nil {
+		c.clock = DefaultClock
+	}
 
 	if !filepath.IsAbs(c.rootPath) {
 		c.rootPath = filepath.Join(macaron.Root, c.rootPath)
@@ -202,7 +415,7 @@ func (c *FileCacher) StartAndGC(opt Options) error {
 		return err
 	}
 
-	go c.startGC()
+	c.clock.AfterFunc(0, func() { c.startGC() })
 	return nil
 }
 
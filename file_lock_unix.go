@@ -0,0 +1,95 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile acquires the exclusive lock of given file, creating it if needed.
+func lockFile(name string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+		unlock := func() error {
+			err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+
+		// The file may have been removed by removeLockFile while waiting,
+		// in which case another process can lock a new one.
+		locked, err := isLockedFile(f, name)
+		if err != nil {
+			_ = unlock()
+			return nil, err
+		} else if locked {
+			return unlock, nil
+		}
+		_ = unlock()
+	}
+}
+
+// isLockedFile returns true if given open file is still the one by its name.
+func isLockedFile(f *os.File, name string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	cur, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, cur), nil
+}
+
+// removeLockFile deletes given lock file if it is not locked.
+func removeLockFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	if locked, err := isLockedFile(f, name); !locked || err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
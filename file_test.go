@@ -15,9 +15,13 @@
 package cache
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -33,3 +37,157 @@ func Test_FileCacher(t *testing.T) {
 		})
 	})
 }
+
+func Test_FileCacher_Clock(t *testing.T) {
+	Convey("Expire items with fake clock", t, func() {
+		dir := path.Join(os.TempDir(), "data/caches_clock")
+		os.RemoveAll(dir)
+
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewFileCacher()
+		So(c.StartAndGC(Options{AdapterConfig: dir, Interval: 60, Clock: clock}), ShouldBeNil)
+
+		So(c.Put("uname", "unknwon", 10), ShouldBeNil)
+		clock.Advance(9 * time.Second)
+		So(c.Get("uname"), ShouldEqual, "unknwon")
+		clock.Advance(time.Second)
+		So(c.IsExist("uname"), ShouldBeFalse)
+
+		So(c.Put("uname", "unknwon", 10), ShouldBeNil)
+		clock.Advance(time.Minute)
+		_, err := os.Stat(c.filepath("uname"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
+
+func Test_FileCacher_Crash(t *testing.T) {
+	Convey("Survive partial writes and other processes", t, func() {
+		dir, err := ioutil.TempDir("", "macaron-cache")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		opt := Options{AdapterConfig: dir, Interval: 60, Clock: clock, FileSync: true}
+		c := NewFileCacher()
+		So(c.StartAndGC(opt), ShouldBeNil)
+
+		Convey("Replace files without leaving temporary ones", func() {
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			So(c.Put("uname", "macaron", 0), ShouldBeNil)
+			So(c.Get("uname"), ShouldEqual, "macaron")
+
+			files, err := ioutil.ReadDir(filepath.Dir(c.filepath("uname")))
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 1)
+		})
+
+		Convey("Create files with the mode of plain writes", func() {
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			ref := filepath.Join(dir, "mode.ref")
+			So(ioutil.WriteFile(ref, nil, os.ModePerm), ShouldBeNil)
+
+			want, err := os.Stat(ref)
+			So(err, ShouldBeNil)
+			got, err := os.Stat(c.filepath("uname"))
+			So(err, ShouldBeNil)
+			So(got.Mode(), ShouldEqual, want.Mode())
+		})
+
+		Convey("Leave expired files to GC", func() {
+			So(c.Put("gone", "soon", 10), ShouldBeNil)
+			clock.Advance(10 * time.Second)
+			So(c.Get("gone"), ShouldBeNil)
+			_, err := os.Stat(c.filepath("gone"))
+			So(err, ShouldBeNil)
+
+			clock.Advance(time.Minute)
+			_, err = os.Stat(c.filepath("gone"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Delete lock files of gone keys unless locked", func() {
+			_, err := c.IncrBy("count", 1, 10)
+			So(err, ShouldBeNil)
+			_, err = c.IncrBy("uname", 1, 0)
+			So(err, ShouldBeNil)
+			unlock, err := c.lockKey("held")
+			So(err, ShouldBeNil)
+
+			clock.Advance(time.Minute)
+			_, err = os.Stat(c.filepath("count") + ".lock")
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(c.filepath("uname") + ".lock")
+			So(err, ShouldBeNil)
+			_, err = os.Stat(c.filepath("held") + ".lock")
+			So(err, ShouldBeNil)
+
+			unlock()
+			clock.Advance(time.Minute)
+			_, err = os.Stat(c.filepath("held") + ".lock")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Quarantine corrupt files and keep collecting", func() {
+			So(c.Put("gone", "soon", 10), ShouldBeNil)
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			bad := c.filepath("bad")
+			So(os.MkdirAll(filepath.Dir(bad), os.ModePerm), ShouldBeNil)
+			So(ioutil.WriteFile(bad, []byte("truncated"), 0666), ShouldBeNil)
+			So(c.Get("bad"), ShouldBeNil)
+
+			// Temporary files of writes that crashed long ago are deleted.
+			temp := c.filepath("crashed") + ".tmp123"
+			So(os.MkdirAll(filepath.Dir(temp), os.ModePerm), ShouldBeNil)
+			So(ioutil.WriteFile(temp, []byte("partial"), 0666), ShouldBeNil)
+			old := time.Now().Add(-2 * fileTempMaxAge)
+			So(os.Chtimes(temp, old, old), ShouldBeNil)
+
+			clock.Advance(time.Minute)
+			_, err := os.Stat(bad)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(filepath.Join(dir, fileQuarantineDir, filepath.Base(bad)))
+			So(err, ShouldBeNil)
+			_, err = os.Stat(temp)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(c.IsExist("gone"), ShouldBeFalse)
+			_, err = os.Stat(c.filepath("gone"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+
+			var keys []string
+			So(c.Scan(func(e Entry) bool {
+				keys = append(keys, e.Key)
+				return true
+			}), ShouldBeNil)
+			So(keys, ShouldResemble, []string{"uname"})
+		})
+
+		Convey("Serialize counters across cachers sharing the directory", func() {
+			// Cachers do not share in-process locks, like separate processes.
+			c2 := NewFileCacher()
+			So(c2.StartAndGC(opt), ShouldBeNil)
+			So(c.Put("count", 0, 0), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for _, c := range []*FileCacher{c, c2} {
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(c *FileCacher) {
+						defer wg.Done()
+						for j := 0; j < 5; j++ {
+							if err := c.Incr("count"); err != nil {
+								t.Error(err)
+							}
+						}
+					}(c)
+				}
+			}
+			wg.Wait()
+			So(c.Get("count"), ShouldEqual, 100)
+
+			n, err := c2.IncrBy("count", -50, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 50)
+		})
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"reflect"
+
+	"gopkg.in/macaron.v1"
+)
+
+// FragmentPrefix is the prefix of cache keys of rendered fragments.
+const FragmentPrefix = "fragment:"
+
+var cacheType = reflect.TypeOf((*Cache)(nil)).Elem()
+
+// fromContext returns the cache.Cache mapped by Cacher.
+func fromContext(ctx *macaron.Context) (Cache, error) {
+	val := ctx.GetVal(cacheType)
+	if !val.IsValid() {
+		return nil, errors.New("cache: middleware cache hasn't been registered")
+	}
+	return val.Interface().(Cache), nil
+}
+
+// Fragment returns the HTML fragment cached under given key, or renders it
+// with fn and caches the result for ttl seconds in the cache.Cache mapped by Cacher.
+// Errors of caching the result are logged, and the rendered fragment is still returned.
+func Fragment(ctx *macaron.Context, key string, ttl int64, fn func() (string, error)) (template.HTML, error) {
+	c, err := fromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if val, ok := c.Get(FragmentPrefix + key).(string); ok {
+		return template.HTML(val), nil
+	}
+
+	html, err := fn()
+	if err != nil {
+		return "", err
+	}
+	if err = c.Put(FragmentPrefix+key, html, ttl); err != nil {
+		log.Printf("cache: error caching fragment '%s': %v", key, err)
+	}
+	return template.HTML(html), nil
+}
+
+// InvalidateFragment deletes the HTML fragment cached under given key.
+func InvalidateFragment(c Cache, key string) error {
+	return c.Delete(FragmentPrefix + key)
+}
+
+// FragmentFuncs returns template functions for fragment caching, they are meant
+// to be added to macaron.RenderOptions.Funcs. The "fragment" function renders
+// a template through the render middleware and caches the result:
+//
+//	{{fragment $.Ctx "sidebar" 300 "partials/sidebar" .}}
+//
+// The current *macaron.Context must be available in data, for example
+// by setting ctx.Data["Ctx"] = ctx in a handler.
+func FragmentFuncs() template.FuncMap {
+	return template.FuncMap{
+		"fragment": func(ctx *macaron.Context, key string, ttl int64, name string, data interface{}) (template.HTML, error) {
+			return Fragment(ctx, key, ttl, func() (string, error) {
+				return ctx.HTMLString(name, data)
+			})
+		},
+	}
+}
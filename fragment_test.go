@@ -0,0 +1,100 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Fragment(t *testing.T) {
+	Convey("Cache rendered fragments", t, func() {
+		m := macaron.New()
+		m.Use(Cacher(Options{Adapter: "memory", Interval: 60}))
+		So(adapters["memory"].Flush(), ShouldBeNil)
+		m.Use(macaron.Renderer(macaron.RenderOptions{
+			Directory: "testdata/templates",
+			Funcs:     []template.FuncMap{FragmentFuncs()},
+		}))
+
+		m.Get("/helper", func(ctx *macaron.Context, c Cache) string {
+			html, err := Fragment(ctx, "helper", 60, func() (string, error) {
+				return "<b>" + ctx.Query("name") + "</b>", nil
+			})
+			So(err, ShouldBeNil)
+
+			_, err = Fragment(ctx, "error", 60, func() (string, error) {
+				return "", errors.New("render error")
+			})
+			So(err, ShouldNotBeNil)
+			So(c.IsExist(FragmentPrefix+"error"), ShouldBeFalse)
+			return string(html)
+		})
+		m.Get("/down", func(ctx *macaron.Context) string {
+			flaky := newFlakyCacher()
+			flaky.down = 1
+			ctx.MapTo(flaky, (*Cache)(nil))
+			html, err := Fragment(ctx, "down", 60, func() (string, error) {
+				return "<b>down</b>", nil
+			})
+			So(err, ShouldBeNil)
+			return string(html)
+		})
+		m.Get("/template", func(ctx *macaron.Context) {
+			ctx.Data["Ctx"] = ctx
+			ctx.Data["Name"] = ctx.Query("name")
+			ctx.HTML(http.StatusOK, "page")
+		})
+		m.Get("/invalidate", func(c Cache) {
+			So(InvalidateFragment(c, "sidebar"), ShouldBeNil)
+		})
+
+		serve := func(url string) string {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", url, nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(resp, req)
+			return resp.Body.String()
+		}
+
+		So(serve("/helper?name=macaron"), ShouldEqual, "<b>macaron</b>")
+		So(serve("/helper?name=unknwon"), ShouldEqual, "<b>macaron</b>")
+		So(serve("/down"), ShouldEqual, "<b>down</b>")
+
+		So(serve("/template?name=macaron"), ShouldEqual, "<main><aside>macaron</aside></main>")
+		So(serve("/template?name=unknwon"), ShouldEqual, "<main><aside>macaron</aside></main>")
+		serve("/invalidate")
+		So(serve("/template?name=unknwon"), ShouldEqual, "<main><aside>unknwon</aside></main>")
+	})
+
+	Convey("Require cache middleware", t, func() {
+		m := macaron.New()
+		m.Get("/", func(ctx *macaron.Context) {
+			_, err := Fragment(ctx, "sidebar", 60, func() (string, error) { return "", nil })
+			So(err, ShouldNotBeNil)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrScanUnsupported is returned when the adapter does not implement Scanner.
+var ErrScanUnsupported = errors.New("cache: adapter does not support scanning")
+
+// Entry describes a cached value.
+type Entry struct {
+	Key string
+	// Size of the encoded value in bytes, -1 if unknown.
+	Size int64
+	// Time the value expires, zero if it does not expire.
+	Expires time.Time
+}
+
+// TTL returns time left before the value expires, or -1 if it does not expire.
+func (e Entry) TTL(now time.Time) time.Duration {
+	if e.Expires.IsZero() {
+		return -1
+	} else if ttl := e.Expires.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// Scanner is implemented by adapters that can enumerate and describe cached values.
+type Scanner interface {
+	// Inspect describes cached value by given key, it returns false if the value does not exist.
+	Inspect(key string) (Entry, bool)
+	// Scan calls fn with every cached value in no particular order until fn returns false.
+	// Values stored without their original key, such as ones hashed by older versions, are skipped.
+	Scan(fn func(Entry) bool) error
+}
+
+// StatsReporter is implemented by adapters that report statistics.
+type StatsReporter interface {
+	// Stats returns statistics of the adapter by name, such as number of items.
+	Stats() map[string]int64
+}
+
+// expiresAt returns the time a value created at given Unix time expires,
+// zero if it does not expire.
+func expiresAt(created, expire int64) time.Time {
+	if expire <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(created+expire, 0)
+}
+
+// NewEntry returns an Entry of a value created at given Unix time with expire time
+// in seconds, it is meant for adapters implementing Scanner.
+func NewEntry(key string, size, created, expire int64) Entry {
+	return Entry{
+		Key:     key,
+		Size:    size,
+		Expires: expiresAt(created, expire),
+	}
+}
+
+// EncodedSize returns size of given value encoded by EncodeGob, or -1 if it cannot be encoded.
+func EncodedSize(val interface{}) int64 {
+	if v, ok := val.(gobValue); ok {
+		return v.Size()
+	}
+	data, err := EncodeGob(&Item{Val: val})
+	if err != nil {
+		return -1
+	}
+	return int64(len(data))
+}
+
+// patternRegexp compiles the glob pattern, see MatchPattern.
+func patternRegexp(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// MatchPattern returns true if key matches the glob pattern, in which
+// '*' matches any sequence of characters and '?' matches any single character.
+func MatchPattern(pattern, key string) bool {
+	return patternRegexp(pattern).MatchString(key)
+}
+
+// deleteMatching deletes cached values whose key match returns true for.
+func deleteMatching(c Cache, match func(string) bool) (int, error) {
+	scanner, ok := c.(Scanner)
+	if !ok {
+		return 0, ErrScanUnsupported
+	}
+
+	var keys []string
+	if err := scanner.Scan(func(e Entry) bool {
+		if match(e.Key) {
+			keys = append(keys, e.Key)
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := c.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// DeletePattern deletes cached values whose key matches the glob pattern, see MatchPattern.
+// It returns the number of deleted values.
+func DeletePattern(c Cache, pattern string) (int, error) {
+	return deleteMatching(c, patternRegexp(pattern).MatchString)
+}
+
+// FlushPrefix deletes cached values whose key starts with given prefix.
+// It returns the number of deleted values.
+func FlushPrefix(c Cache, prefix string) (int, error) {
+	return deleteMatching(c, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
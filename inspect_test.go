@@ -0,0 +1,87 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MatchPattern(t *testing.T) {
+	Convey("Match glob patterns", t, func() {
+		So(MatchPattern("user:*", "user:1"), ShouldBeTrue)
+		So(MatchPattern("user:*", "user:"), ShouldBeTrue)
+		So(MatchPattern("user:*", "users:1"), ShouldBeFalse)
+		So(MatchPattern("user:?:name", "user:1:name"), ShouldBeTrue)
+		So(MatchPattern("user:?:name", "user:10:name"), ShouldBeFalse)
+		So(MatchPattern("a.b", "axb"), ShouldBeFalse)
+	})
+}
+
+func Test_Scanner(t *testing.T) {
+	Convey("Scan cached values", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		dir := path.Join(os.TempDir(), "data/scan")
+		os.RemoveAll(dir)
+
+		for _, c := range []Cache{NewMemoryCacher(), NewFileCacher()} {
+			So(c.StartAndGC(Options{AdapterConfig: dir, Clock: clock}), ShouldBeNil)
+			So(c.Put("user:1", "unknwon", 60), ShouldBeNil)
+			So(c.Put("user:2", "macaron", 0), ShouldBeNil)
+			So(c.Put("post:1", "hello", 10), ShouldBeNil)
+			So(c.Put("post:2", "world", 1), ShouldBeNil)
+			clock.Advance(time.Second)
+
+			scanner := c.(Scanner)
+			e, ok := scanner.Inspect("user:1")
+			So(ok, ShouldBeTrue)
+			So(e.Key, ShouldEqual, "user:1")
+			So(e.Size, ShouldBeGreaterThan, 0)
+			So(e.TTL(clock.Now()), ShouldEqual, 59*time.Second)
+			e, ok = scanner.Inspect("user:2")
+			So(ok, ShouldBeTrue)
+			So(e.TTL(clock.Now()), ShouldEqual, -1)
+			_, ok = scanner.Inspect("post:2")
+			So(ok, ShouldBeFalse)
+
+			var keys []string
+			So(scanner.Scan(func(e Entry) bool {
+				keys = append(keys, e.Key)
+				return true
+			}), ShouldBeNil)
+			sort.Strings(keys)
+			So(keys, ShouldResemble, []string{"post:1", "user:1", "user:2"})
+
+			n, err := DeletePattern(c, "user:*")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(c.Get("user:1"), ShouldBeNil)
+			So(c.Get("post:1"), ShouldNotBeNil)
+
+			n, err = FlushPrefix(c, "post:")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(c.Get("post:1"), ShouldBeNil)
+		}
+
+		_, err := FlushPrefix(NewNullCacher(false), "post:")
+		So(err, ShouldEqual, ErrScanUnsupported)
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/siddontang/ledisdb/config"
@@ -34,6 +35,8 @@ var defaultHSetName = []byte("MacaronCache")
 type LedisCacher struct {
 	c        *ledis.DB
 	interval int
+	clock    cache.Clock
+	lock     sync.Mutex // Serializes counter updates, the db is opened by this process only.
 }
 
 // Put puts value into cache with key and expire time.
@@ -50,7 +53,7 @@ func (c *LedisCacher) Put(key string, val interface{}, expire int64) (err error)
 	if err = c.c.SetEX([]byte(key), expire, []byte(com.ToStr(val))); err != nil {
 		return err
 	}
-	_, err = c.c.HSet([]byte(key), defaultHSetName, []byte(com.ToStr(time.Now().Add(time.Duration(expire)*time.Second).Unix())))
+	_, err = c.c.HSet([]byte(key), defaultHSetName, []byte(com.ToStr(c.clock.Now().Add(time.Duration(expire)*time.Second).Unix())))
 	return err
 }
 
@@ -90,6 +93,18 @@ func (c *LedisCacher) Decr(key string) error {
 	return err
 }
 
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *LedisCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.IsExist(key) {
+		return delta, c.Put(key, delta, expire)
+	}
+	return c.c.IncrBy([]byte(key), delta)
+}
+
 // IsExist returns true if cached value exists.
 func (c *LedisCacher) IsExist(key string) bool {
 	count, err := c.c.Exists([]byte(key))
@@ -128,7 +143,7 @@ func (c *LedisCacher) startGC() {
 		return
 	}
 
-	now := time.Now().Unix()
+	now := c.clock.Now().Unix()
 	for _, v := range kvs {
 		expire := com.StrTo(v.Value).MustInt64()
 		if expire == 0 || now < expire {
@@ -141,13 +156,17 @@ func (c *LedisCacher) startGC() {
 		}
 	}
 
-	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+	c.clock.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
 }
 
 // StartAndGC starts GC routine based on config string settings.
 // AdapterConfig: data_dir=./app.db,db=0
 func (c *LedisCacher) StartAndGC(opts cache.Options) error {
 	c.interval = opts.Interval
+	c.clock = opts.Clock
+	if c.clock == nil {
+		c.clock = cache.DefaultClock
+	}
 
 	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
 	if err != nil {
@@ -176,7 +195,7 @@ func (c *LedisCacher) StartAndGC(opts cache.Options) error {
 		return err
 	}
 
-	go c.startGC()
+	c.clock.AfterFunc(0, func() { c.startGC() })
 	return nil
 }
 
@@ -83,6 +83,15 @@ func Test_LedisCacher(t *testing.T) {
 				So(c.Incr("string"), ShouldNotBeNil)
 				So(c.Decr("string"), ShouldNotBeNil)
 
+				n, err := cache.Increment(c, "counter", 2, 60)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 2)
+				n, err = cache.Increment(c, "counter", -5, 60)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, -3)
+				_, err = cache.Increment(c, "string", 1, 60)
+				So(err, ShouldNotBeNil)
+
 				So(com.StrTo(c.Get("int").(string)).MustInt(), ShouldEqual, 0)
 				So(com.StrTo(c.Get("int64").(string)).MustInt64(), ShouldEqual, 0)
 
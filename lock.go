@@ -0,0 +1,132 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	mrand "math/rand"
+	"time"
+)
+
+const (
+	// LockPrefix is the prefix of cache keys of locks.
+	LockPrefix = "lock:"
+	// FenceSuffix is appended to the cache key of a lock to keep its fencing token.
+	FenceSuffix = ":fence"
+	// FenceExpire is the expire time in seconds of fencing tokens for adapters
+	// that garbage collect keys without expire time.
+	FenceExpire = math.MaxInt32
+)
+
+var (
+	// ErrLockHeld is returned when the lock is held by another owner.
+	ErrLockHeld = errors.New("cache: lock is held by another owner")
+	// ErrLockLost is returned when the lock has expired or been taken by another owner.
+	ErrLockLost = errors.New("cache: lock is not held anymore")
+	// ErrLockUnsupported is returned when the adapter does not implement Locker.
+	ErrLockUnsupported = errors.New("cache: adapter does not support locks")
+	// ErrLockTTL is returned when a lock is refreshed with a non-positive ttl.
+	ErrLockTTL = errors.New("cache: lock ttl must be positive")
+)
+
+// Lock represents a lock held in the cache.
+type Lock interface {
+	// Token returns the fencing token of the lock, which increases every time
+	// the lock of the same key is acquired. Resources protected by the lock
+	// should reject operations with a token lower than one they have seen.
+	Token() int64
+	// Unlock releases the lock, it returns ErrLockLost if the lock is not held anymore.
+	Unlock() error
+	// Refresh extends the lock to expire after ttl, it returns ErrLockLost
+	// if the lock is not held anymore, and ErrLockTTL if ttl is not positive.
+	Refresh(ttl time.Duration) error
+}
+
+// Locker is implemented by adapters that support locks.
+type Locker interface {
+	// Lock acquires the lock of given key that expires after ttl,
+	// it returns ErrLockHeld if the lock is held by another owner.
+	Lock(key string, ttl time.Duration) (Lock, error)
+}
+
+type funcLock struct {
+	token   int64
+	unlock  func() error
+	refresh func(time.Duration) error
+}
+
+func (l *funcLock) Token() int64  { return l.token }
+func (l *funcLock) Unlock() error { return l.unlock() }
+
+func (l *funcLock) Refresh(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrLockTTL
+	}
+	return l.refresh(ttl)
+}
+
+// NewLock returns a Lock with given fencing token that calls given functions
+// to unlock and refresh, it is meant for adapters implementing Locker.
+// refresh is only called with a positive ttl.
+func NewLock(token int64, unlock func() error, refresh func(ttl time.Duration) error) Lock {
+	return &funcLock{
+		token:   token,
+		unlock:  unlock,
+		refresh: refresh,
+	}
+}
+
+// NewLockOwner returns a random value identifying the owner of a lock.
+func NewLockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AcquireLock acquires the lock of given key that expires after ttl,
+// and retries for up to wait when the lock is held by another owner.
+func AcquireLock(c Cache, key string, ttl, wait time.Duration) (Lock, error) {
+	locker, ok := c.(Locker)
+	if !ok {
+		return nil, ErrLockUnsupported
+	}
+
+	deadline := time.Now().Add(wait)
+	delay := 10 * time.Millisecond
+	for {
+		l, err := locker.Lock(key, ttl)
+		if err != ErrLockHeld {
+			return l, err
+		}
+
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return nil, ErrLockHeld
+		}
+		sleep := delay/2 + time.Duration(mrand.Int63n(int64(delay/2)+1))
+		if sleep > remain {
+			sleep = remain
+		}
+		time.Sleep(sleep)
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
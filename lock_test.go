@@ -0,0 +1,179 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Lock(t *testing.T) {
+	Convey("Lock with memory cache adapter", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{Clock: clock}), ShouldBeNil)
+
+		l, err := c.Lock("job", 10*time.Second)
+		So(err, ShouldBeNil)
+		So(l.Token(), ShouldEqual, 1)
+		_, err = c.Lock("job", 10*time.Second)
+		So(err, ShouldEqual, ErrLockHeld)
+
+		Convey("Unlock", func() {
+			So(l.Unlock(), ShouldBeNil)
+			So(l.Unlock(), ShouldEqual, ErrLockLost)
+			So(l.Refresh(time.Second), ShouldEqual, ErrLockLost)
+
+			l2, err := c.Lock("job", 10*time.Second)
+			So(err, ShouldBeNil)
+			So(l2.Token(), ShouldEqual, 2)
+		})
+
+		Convey("Expire and refresh", func() {
+			clock.Advance(9 * time.Second)
+			So(l.Refresh(10*time.Second), ShouldBeNil)
+			clock.Advance(9 * time.Second)
+			_, err = c.Lock("job", 10*time.Second)
+			So(err, ShouldEqual, ErrLockHeld)
+
+			clock.Advance(time.Second)
+			l2, err := c.Lock("job", 10*time.Second)
+			So(err, ShouldBeNil)
+			So(l2.Token(), ShouldEqual, 2)
+			So(l.Refresh(10*time.Second), ShouldEqual, ErrLockLost)
+			So(l.Unlock(), ShouldEqual, ErrLockLost)
+			So(l2.Unlock(), ShouldBeNil)
+		})
+
+		Convey("Refuse to refresh with non-positive ttl", func() {
+			So(l.Refresh(0), ShouldEqual, ErrLockTTL)
+			So(l.Refresh(-time.Second), ShouldEqual, ErrLockTTL)
+			_, err = c.Lock("job", 10*time.Second)
+			So(err, ShouldEqual, ErrLockHeld)
+			So(l.Unlock(), ShouldBeNil)
+		})
+
+		Convey("Drop expired locks in GC", func() {
+			So(c.StartAndGC(Options{Clock: clock, Interval: 1}), ShouldBeNil)
+			clock.Advance(10 * time.Second)
+			c.locks.lock.Lock()
+			held := len(c.locks.held)
+			c.locks.lock.Unlock()
+			So(held, ShouldEqual, 0)
+
+			l2, err := c.Lock("job", 10*time.Second)
+			So(err, ShouldBeNil)
+			So(l2.Token(), ShouldEqual, 2)
+		})
+
+		Convey("Keep fencing tokens after flush", func() {
+			So(c.Flush(), ShouldBeNil)
+			So(l.Unlock(), ShouldBeNil)
+			l2, err := c.Lock("job", 10*time.Second)
+			So(err, ShouldBeNil)
+			So(l2.Token(), ShouldEqual, 2)
+		})
+
+		Convey("Lock while the clock is replaced", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 10; i++ {
+					_ = c.StartAndGC(Options{Clock: NewFakeClock(time.Unix(1e9, 0))})
+				}
+			}()
+			for i := 0; i < 10; i++ {
+				if l, err := c.Lock("other", time.Second); err == nil {
+					So(l.Unlock(), ShouldBeNil)
+				}
+			}
+			<-done
+		})
+	})
+
+	Convey("Acquire locks", t, func() {
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{}), ShouldBeNil)
+
+		Convey("Wait for the lock", func() {
+			var (
+				wg      sync.WaitGroup
+				holders int32
+				tokens  sync.Map
+			)
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					l, err := AcquireLock(c, "job", time.Minute, 5*time.Second)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if atomic.AddInt32(&holders, 1) != 1 {
+						t.Error("lock is held by more than one owner")
+					}
+					tokens.Store(l.Token(), true)
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt32(&holders, -1)
+					if err = l.Unlock(); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			for i := int64(1); i <= 5; i++ {
+				_, ok := tokens.Load(i)
+				So(ok, ShouldBeTrue)
+			}
+		})
+
+		Convey("Give up waiting", func() {
+			_, err := AcquireLock(c, "job", time.Minute, 0)
+			So(err, ShouldBeNil)
+			_, err = AcquireLock(c, "job", time.Minute, 50*time.Millisecond)
+			So(err, ShouldEqual, ErrLockHeld)
+		})
+
+		Convey("Lock in sharded cache", func() {
+			sharded := NewShardedCacher(DefaultVirtualNodes)
+			So(sharded.AddShard("memory", c), ShouldBeNil)
+			So(sharded.AddShard("null", NewNullCacher(false)), ShouldBeNil)
+
+			var supported, unsupported bool
+			for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+				_, err := AcquireLock(sharded, key, time.Minute, 0)
+				switch err {
+				case nil:
+					supported = true
+				case ErrLockUnsupported:
+					unsupported = true
+				}
+			}
+			So(supported, ShouldBeTrue)
+			So(unsupported, ShouldBeTrue)
+		})
+
+		Convey("Adapter does not support locks", func() {
+			_, err := AcquireLock(NewNullCacher(false), "job", time.Minute, time.Second)
+			So(err, ShouldEqual, ErrLockUnsupported)
+		})
+	})
+}
@@ -16,7 +16,9 @@
 package cache
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/unknwon/com"
@@ -69,6 +71,95 @@ func (c *MemcacheCacher) Decr(key string) error {
 	return err
 }
 
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+// Memcache counters are unsigned, they do not go below zero.
+func (c *MemcacheCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	for i := 0; i < 3; i++ {
+		var (
+			n   uint64
+			err error
+		)
+		if delta >= 0 {
+			n, err = c.c.Increment(key, uint64(delta))
+		} else {
+			n, err = c.c.Decrement(key, uint64(-delta))
+		}
+		if err == nil {
+			return int64(n), nil
+		} else if err != memcache.ErrCacheMiss {
+			return 0, err
+		}
+
+		start := delta
+		if start < 0 {
+			start = 0
+		}
+		err = c.c.Add(NewItem(key, []byte(com.ToStr(start)), int32(expire)))
+		if err == nil {
+			return start, nil
+		} else if err != memcache.ErrNotStored {
+			return 0, err
+		}
+		// Someone else has just created the counter, add to it instead.
+	}
+	return 0, fmt.Errorf("key '%s' is contended", key)
+}
+
+// seconds returns given duration in whole seconds, rounded up.
+func seconds(d time.Duration) int32 {
+	return int32((d + time.Second - 1) / time.Second)
+}
+
+// Lock acquires the lock of given key that expires after ttl rounded up to seconds,
+// it returns cache.ErrLockHeld if the lock is held by another owner. Fencing tokens
+// are kept as counters that may be evicted when memcache runs out of memory.
+func (c *MemcacheCacher) Lock(key string, ttl time.Duration) (cache.Lock, error) {
+	owner, err := cache.NewLockOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	key = cache.LockPrefix + key
+	if err = c.c.Add(NewItem(key, []byte(owner), seconds(ttl))); err == memcache.ErrNotStored {
+		return nil, cache.ErrLockHeld
+	} else if err != nil {
+		return nil, err
+	}
+
+	token, err := c.IncrBy(key+cache.FenceSuffix, 1, 0)
+	if err != nil {
+		_ = c.swapLock(key, owner, -1)
+		return nil, err
+	}
+
+	return cache.NewLock(token, func() error {
+		return c.swapLock(key, owner, -1)
+	}, func(ttl time.Duration) error {
+		return c.swapLock(key, owner, seconds(ttl))
+	}), nil
+}
+
+// swapLock sets new expire time of the lock only if it is still held by the owner,
+// a negative expire time deletes the lock.
+func (c *MemcacheCacher) swapLock(key, owner string, expire int32) error {
+	item, err := c.c.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return cache.ErrLockLost
+	} else if err != nil {
+		return err
+	} else if string(item.Value) != owner {
+		return cache.ErrLockLost
+	}
+
+	item.Expiration = expire
+	err = c.c.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return cache.ErrLockLost
+	}
+	return err
+}
+
 // IsExist returns true if cached value exists.
 func (c *MemcacheCacher) IsExist(key string) bool {
 	_, err := c.c.Get(key)
@@ -80,6 +171,23 @@ func (c *MemcacheCacher) Flush() error {
 	return c.c.FlushAll()
 }
 
+// Ping returns an error if the memcache server cannot be reached.
+func (c *MemcacheCacher) Ping() error {
+	_, err := c.c.Get("macaron_cache_ping")
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// IsRetryable returns true if the operation failed with given error may succeed on retry.
+func (c *MemcacheCacher) IsRetryable(err error) bool {
+	if _, ok := err.(*memcache.ConnectTimeoutError); ok {
+		return true
+	}
+	return cache.IsTransientError(err)
+}
+
 // StartAndGC starts GC routine based on config string settings.
 // AdapterConfig: 127.0.0.1:9090;127.0.0.1:9091
 func (c *MemcacheCacher) StartAndGC(opt cache.Options) error {
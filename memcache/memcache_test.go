@@ -98,5 +98,32 @@ func Test_MemcacheCacher(t *testing.T) {
 			So(err, ShouldBeNil)
 			m.ServeHTTP(resp, req)
 		})
+
+		Convey("Lock operations", func() {
+			m := macaron.New()
+			m.Use(cache.Cacher(opt))
+
+			m.Get("/", func(c cache.Cache) {
+				l, err := cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldBeNil)
+				_, err = cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldEqual, cache.ErrLockHeld)
+
+				So(l.Refresh(3*time.Second), ShouldBeNil)
+				So(l.Unlock(), ShouldBeNil)
+				So(l.Unlock(), ShouldEqual, cache.ErrLockLost)
+
+				l2, err := cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldBeNil)
+				So(l2.Token(), ShouldBeGreaterThan, l.Token())
+				So(l.Refresh(time.Second), ShouldEqual, cache.ErrLockLost)
+				So(l2.Unlock(), ShouldBeNil)
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(resp, req)
+		})
 	})
 }
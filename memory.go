@@ -17,129 +17,561 @@ package cache
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Sizer is implemented by values that know their size in bytes, which
+// is used to enforce Options.MaxBytes of the memory adapter.
+type Sizer interface {
+	Size() int64
+}
+
+// sizeOf returns size of given value, values that do not implement Sizer
+// are estimated by their encoded length.
+func sizeOf(val interface{}) int64 {
+	switch val := val.(type) {
+	case Sizer:
+		return val.Size()
+	case string:
+		return int64(len(val))
+	case []byte:
+		return int64(len(val))
+	}
+	if size := EncodedSize(val); size >= 0 {
+		return size
+	}
+	return int64(len(fmt.Sprint(val)))
+}
+
 // MemoryItem represents a memory cache item.
 type MemoryItem struct {
+	key     string
 	val     interface{}
 	created int64
 	expire  int64
+	size    int64 // Size of key and value.
+	index   int   // Position in the expiry heap of the shard, -1 if it is not in it.
 }
 
-func (item *MemoryItem) hasExpired() bool {
+func (item *MemoryItem) hasExpired(now time.Time) bool {
 	return item.expire > 0 &&
-		(time.Now().Unix()-item.created) >= item.expire
+		(now.Unix()-item.created) >= item.expire
+}
+
+// deadline returns the Unix time the item expires at.
+func (item *MemoryItem) deadline() int64 {
+	return item.created + item.expire
+}
+
+const (
+	// Maximum number of shards of a MemoryCacher.
+	memoryShards = 32
+	// Minimum limits of a shard. Caches with lower limits use fewer shards,
+	// so that small caches evict items in the same order as a single shard.
+	memoryShardMinEntries = 1024
+	memoryShardMinBytes   = 1 << 20
+)
+
+// memoryShardCount returns the number of shards of a cache with given limits.
+func memoryShardCount(maxEntries int, maxBytes int64) int {
+	n := memoryShards
+	for n > 1 &&
+		((maxEntries > 0 && maxEntries/n < memoryShardMinEntries) ||
+			(maxBytes > 0 && maxBytes/int64(n) < memoryShardMinBytes)) {
+		n /= 2
+	}
+	return n
+}
+
+// fnv32 returns the FNV-1a hash of given key.
+func fnv32(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// memoryShard holds the items of a MemoryCacher whose keys hash to it,
+// with its share of the limits of the cache.
+type memoryShard struct {
+	lock       sync.RWMutex
+	items      map[string]*MemoryItem
+	policy     evictionPolicy // Nil if the cache is not bounded.
+	expiry     expiryHeap
+	clock      Clock
+	maxEntries int
+	maxBytes   int64
+	bytes      int64 // Total size of items, only tracked when bounded by MaxBytes.
+	evictions  int64
+	retired    bool // True once items have been moved to new shards.
+
+	spill      *FileCacher             // Nil if evicted items are not spilled.
+	spilled    map[string]*spilledItem // Spilled items by key.
+	pending    []string                // Keys whose spill files are changed by unlock.
+	spills     int64
+	promotions int64
+}
+
+// sizeOf returns size of given key and value. Sizes are only
+// computed when the shard is bounded by MaxBytes, as they may be costly.
+func (s *memoryShard) sizeOf(key string, val interface{}) int64 {
+	if s.maxBytes <= 0 {
+		return 0
+	}
+	return int64(len(key)) + sizeOf(val)
+}
+
+// set stores the item by given key and evicts items over the limits.
+// Items larger than MaxBytes are evicted right away.
+// It must be called with the lock held.
+func (s *memoryShard) set(key string, item *MemoryItem) {
+	if old, ok := s.items[key]; ok {
+		s.remove(key, old)
+	}
+	s.unspill(key)
+	s.expireDue(s.clock.Now(), memoryWriteExpire)
+
+	item.key = key
+	item.size = s.sizeOf(key, item.val)
+	if s.maxBytes > 0 && item.size > s.maxBytes {
+		// Evicting other items would not make room for it.
+		s.evictions++
+		s.spillItem(key, item)
+		return
+	}
+	s.items[key] = item
+	s.bytes += item.size
+	s.schedule(item)
+	if s.policy != nil {
+		s.policy.add(key)
+		s.evict()
+	}
+}
+
+// resize updates size of the item after its value has changed.
+// It must be called with the lock held.
+func (s *memoryShard) resize(key string, item *MemoryItem) {
+	size := s.sizeOf(key, item.val)
+	s.bytes += size - item.size
+	item.size = size
+	s.evict()
+}
+
+// remove deletes the item by given key. It must be called with the lock held.
+func (s *memoryShard) remove(key string, item *MemoryItem) {
+	delete(s.items, key)
+	s.bytes -= item.size
+	s.unschedule(item)
+	if s.policy != nil {
+		s.policy.remove(key)
+	}
+}
+
+// evict removes items chosen by the eviction policy until the shard is
+// within its limits. It must be called with the lock held.
+func (s *memoryShard) evict() {
+	for s.policy != nil && len(s.items) > 0 &&
+		((s.maxEntries > 0 && len(s.items) > s.maxEntries) ||
+			(s.maxBytes > 0 && s.bytes > s.maxBytes)) {
+		key := s.policy.victim()
+		item := s.items[key]
+		s.remove(key, item)
+		s.evictions++
+		s.spillItem(key, item)
+	}
+}
+
+// checkRawExpiration deletes the item by given key if it has expired.
+// It must be called with the lock held.
+func (s *memoryShard) checkRawExpiration(key string) {
+	item, ok := s.items[key]
+	if !ok {
+		return
+	}
+
+	if item.hasExpired(s.clock.Now()) {
+		s.remove(key, item)
+	}
 }
 
 // MemoryCacher represents a memory cache adapter implementation.
+// Values are stored as given unless Options.IsolateValues is set.
+// Items are spread over shards with their own locks by hash of the key,
+// so that operations on different keys rarely wait for each other.
+// When bounded by Options.MaxEntries or Options.MaxBytes, items are
+// evicted by Options.EvictionPolicy to make room for new ones, and
+// spilled to Options.SpillDir if set.
 type MemoryCacher struct {
-	lock     sync.RWMutex
-	items    map[string]*MemoryItem
-	interval int // GC interval.
+	hits       int64        // Accessed atomically.
+	misses     int64        // Accessed atomically.
+	isolate    int32        // Accessed atomically, 1 if values are isolated.
+	shards     atomic.Value // []*memoryShard, replaced by StartAndGC.
+	lock       sync.Mutex   // Guards configuration below.
+	interval   int          // GC interval.
+	gcShard    int          // Shard the next GC pass starts at.
+	clock      Clock
+	maxEntries int
+	maxBytes   int64
+	locks      memoryLocks
+	spill      *FileCacher
+
+	snapshotFile     string
+	snapshotInterval int
+	snapshotTimer    Timer
+	snapshotGen      int // Incremented to stop scheduled snapshots.
 }
 
 // NewMemoryCacher creates and returns a new memory cacher.
 func NewMemoryCacher() *MemoryCacher {
-	return &MemoryCacher{items: make(map[string]*MemoryItem)}
+	c := &MemoryCacher{clock: DefaultClock}
+	c.shards.Store(newMemoryShards(1, DefaultClock))
+	return c
+}
+
+func newMemoryShards(n int, clock Clock) []*memoryShard {
+	shards := make([]*memoryShard, n)
+	for i := range shards {
+		shards[i] = &memoryShard{
+			items:   make(map[string]*MemoryItem),
+			clock:   clock,
+			spilled: make(map[string]*spilledItem),
+		}
+	}
+	return shards
+}
+
+func (c *MemoryCacher) loadShards() []*memoryShard {
+	shards, _ := c.shards.Load().([]*memoryShard)
+	return shards
+}
+
+// shard returns the shard of given key locked for writing.
+func (c *MemoryCacher) shard(key string) *memoryShard {
+	for {
+		shards := c.loadShards()
+		s := shards[fnv32(key)%uint32(len(shards))]
+		s.lock.Lock()
+		if !s.retired {
+			return s
+		}
+		s.lock.Unlock()
+	}
+}
+
+// rshard returns the shard of given key locked for reading.
+func (c *MemoryCacher) rshard(key string) *memoryShard {
+	for {
+		shards := c.loadShards()
+		s := shards[fnv32(key)%uint32(len(shards))]
+		s.lock.RLock()
+		if !s.retired {
+			return s
+		}
+		s.lock.RUnlock()
+	}
+}
+
+func (c *MemoryCacher) isolated() bool {
+	return atomic.LoadInt32(&c.isolate) == 1
 }
 
 // Put puts value into cache with key and expire time.
 // If expired is 0, it will be deleted by next GC operation.
 func (c *MemoryCacher) Put(key string, val interface{}, expire int64) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	if c.isolated() {
+		var err error
+		if val, err = isolate(val); err != nil {
+			return err
+		}
+	}
+
+	s := c.shard(key)
+	defer s.unlock()
 
-	c.items[key] = &MemoryItem{
+	s.set(key, &MemoryItem{
 		val:     val,
-		created: time.Now().Unix(),
+		created: s.clock.Now().Unix(),
 		expire:  expire,
-	}
+	})
 	return nil
 }
 
 // Get gets cached value by given key.
 func (c *MemoryCacher) Get(key string) interface{} {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	val := c.get(key)
+	if val != nil {
+		var err error
+		if val, err = unisolate(val, c.isolated()); err != nil {
+			log.Printf("cache/memory: error copying value of '%s': %v", key, err)
+			val = nil
+		}
+	}
+	if val == nil {
+		atomic.AddInt64(&c.misses, 1)
+	} else {
+		atomic.AddInt64(&c.hits, 1)
+	}
+	return val
+}
 
-	item, ok := c.items[key]
-	if !ok {
-		return nil
+func (c *MemoryCacher) get(key string) interface{} {
+	s := c.rshard(key)
+	if s.policy == nil {
+		defer s.lock.RUnlock()
+
+		item, ok := s.items[key]
+		if !ok {
+			return nil
+		} else if item.hasExpired(s.clock.Now()) {
+			// The key may have been put again by the time the lock is taken,
+			// so only delete it if it is still expired.
+			go func() {
+				s := c.shard(key)
+				s.checkRawExpiration(key)
+				s.lock.Unlock()
+			}()
+			return nil
+		}
+		return item.val
 	}
-	if item.hasExpired() {
-		go func() {
-			_ = c.Delete(key)
-		}()
-		return nil
+
+	// Accesses are only recorded when items may be evicted, so that
+	// unbounded caches can keep serving reads concurrently.
+	// The policy of a shard does not change, so it is safe to
+	// upgrade the lock unless the shard has been retired meanwhile.
+	s.lock.RUnlock()
+	s = c.shard(key)
+	item, ok := s.items[key]
+	if ok && item.hasExpired(s.clock.Now()) {
+		s.remove(key, item)
+		ok = false
 	}
-	return item.val
+	if ok {
+		s.policy.hit(key)
+	} else {
+		s.policy.miss(key)
+	}
+	if !ok && s.spill != nil {
+		s.unlock()
+		s, item, ok = c.lookup(key)
+		ok = ok && !item.hasExpired(s.clock.Now())
+	}
+
+	var val interface{}
+	if ok {
+		val = item.val
+	}
+	s.unlock()
+	return val
 }
 
 // Delete deletes cached value by given key.
 func (c *MemoryCacher) Delete(key string) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	s := c.shard(key)
+	defer s.unlock()
 
-	delete(c.items, key)
+	if item, ok := s.items[key]; ok {
+		s.remove(key, item)
+	}
+	s.unspill(key)
 	return nil
 }
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *MemoryCacher) Incr(key string) (err error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	s, item, ok := c.lookup(key)
+	defer s.unlock()
 
-	item, ok := c.items[key]
 	if !ok {
 		return errors.New("key not exist")
 	}
-	item.val, err = Incr(item.val)
+	if item.val, err = Incr(item.val); err == nil {
+		s.resize(key, item)
+	}
 	return err
 }
 
 // Decr decreases cached int-type value by given key as a counter.
 func (c *MemoryCacher) Decr(key string) (err error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	s, item, ok := c.lookup(key)
+	defer s.unlock()
 
-	item, ok := c.items[key]
 	if !ok {
 		return errors.New("key not exist")
 	}
 
-	item.val, err = Decr(item.val)
+	if item.val, err = Decr(item.val); err == nil {
+		s.resize(key, item)
+	}
 	return err
 }
 
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *MemoryCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	s, item, ok := c.lookup(key)
+	defer s.unlock()
+
+	now := s.clock.Now()
+	if !ok || item.hasExpired(now) {
+		s.set(key, &MemoryItem{
+			val:     delta,
+			created: now.Unix(),
+			expire:  expire,
+		})
+		return delta, nil
+	}
+
+	val, err := IncrBy(item.val, delta)
+	if err != nil {
+		return 0, err
+	}
+	item.val = val
+	s.resize(key, item)
+	return ToInt64(val)
+}
+
 // IsExist returns true if cached value exists.
 func (c *MemoryCacher) IsExist(key string) bool {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	s := c.rshard(key)
+	defer s.lock.RUnlock()
 
-	_, ok := c.items[key]
-	return ok
+	now := s.clock.Now()
+	item, ok := s.items[key]
+	return (ok && !item.hasExpired(now)) || s.hasSpilled(key, now)
 }
 
-// Flush deletes all cached data.
-func (c *MemoryCacher) Flush() error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+// Inspect describes cached value by given key, it returns false if the value does not exist.
+// Size of the value is the size it would have encoded by EncodeGob.
+func (c *MemoryCacher) Inspect(key string) (Entry, bool) {
+	s := c.rshard(key)
+	now := s.clock.Now()
+	item, ok := s.items[key]
+	var val interface{}
+	var spill *FileCacher
+	if ok && !item.hasExpired(now) {
+		val = item.val
+	} else if ok = false; s.hasSpilled(key, now) {
+		if item = s.spilled[key].item; item != nil {
+			// The file of the item has not been written yet.
+			val, ok = item.val, true
+		} else {
+			spill = s.spill
+		}
+	}
+	s.lock.RUnlock()
+	if spill != nil {
+		return spill.Inspect(key)
+	} else if !ok {
+		return Entry{}, false
+	}
+	return NewEntry(key, EncodedSize(val), item.created, item.expire), true
+}
+
+// Scan calls fn with every cached value in no particular order until fn returns false.
+// Sizes of values are not computed and reported as -1, including spilled ones.
+func (c *MemoryCacher) Scan(fn func(Entry) bool) error {
+	var entries []Entry
+	for _, s := range c.loadShards() {
+		s.lock.RLock()
+		now := s.clock.Now()
+		for key, item := range s.items {
+			if !item.hasExpired(now) {
+				entries = append(entries, NewEntry(key, -1, item.created, item.expire))
+			}
+		}
+		for key, spilled := range s.spilled {
+			if _, ok := s.items[key]; ok || !s.hasSpilled(key, now) {
+				continue
+			}
+			e := Entry{Key: key, Size: -1}
+			if spilled.deadline > 0 {
+				e.Expires = time.Unix(spilled.deadline, 0)
+			}
+			entries = append(entries, e)
+		}
+		s.lock.RUnlock()
+	}
 
-	c.items = make(map[string]*MemoryItem)
+	for _, e := range entries {
+		if !fn(e) {
+			break
+		}
+	}
 	return nil
 }
 
-func (c *MemoryCacher) checkRawExpiration(key string) {
-	item, ok := c.items[key]
-	if !ok {
-		return
+// Stats returns number of items in the cache, their total size if the cache
+// is bounded by MaxBytes, the limits of the cache, number of items evicted
+// to stay within them, number of hits and misses of Get, and number of shards.
+// When evicted items are spilled, it also returns number of items spilled,
+// promoted back, and currently in the spill directory.
+func (c *MemoryCacher) Stats() map[string]int64 {
+	c.lock.Lock()
+	stats := map[string]int64{
+		"max_entries": int64(c.maxEntries),
+		"max_bytes":   c.maxBytes,
+		"hits":        atomic.LoadInt64(&c.hits),
+		"misses":      atomic.LoadInt64(&c.misses),
 	}
+	spill := c.spill != nil
+	c.lock.Unlock()
+
+	shards := c.loadShards()
+	stats["shards"] = int64(len(shards))
+	for _, s := range shards {
+		s.lock.RLock()
+		stats["items"] += int64(len(s.items))
+		stats["bytes"] += s.bytes
+		stats["evictions"] += s.evictions
+		if spill {
+			stats["spills"] += s.spills
+			stats["promotions"] += s.promotions
+			stats["spilled"] += int64(len(s.spilled))
+		}
+		s.lock.RUnlock()
+	}
+	return stats
+}
 
-	if item.hasExpired() {
-		delete(c.items, key)
+// HitRatio returns the fraction of Get calls that found a value, or 0 if
+// there was none. It is meant for comparing eviction policies on real traffic.
+func (c *MemoryCacher) HitRatio() float64 {
+	hits := atomic.LoadInt64(&c.hits)
+	total := hits + atomic.LoadInt64(&c.misses)
+	if total == 0 {
+		return 0
 	}
+	return float64(hits) / float64(total)
+}
+
+// Flush deletes all cached data.
+func (c *MemoryCacher) Flush() error {
+	for _, s := range c.loadShards() {
+		s.lock.Lock()
+		s.items = make(map[string]*MemoryItem)
+		s.expiry = nil
+		if s.policy != nil {
+			s.policy.reset()
+		}
+		s.bytes = 0
+		s.spilled = make(map[string]*spilledItem)
+		s.lock.Unlock()
+	}
+
+	c.lock.Lock()
+	spill := c.spill
+	c.lock.Unlock()
+	if spill != nil {
+		return spill.Flush()
+	}
+	return nil
 }
 
 func (c *MemoryCacher) startGC() {
@@ -150,25 +582,204 @@ func (c *MemoryCacher) startGC() {
 		return
 	}
 
-	if c.items != nil {
-		for key := range c.items {
-			c.checkRawExpiration(key)
+	// Only items due are visited. If deleting them takes longer than the budget,
+	// the pass continues shortly from the shard it stopped at.
+	next := time.Duration(c.interval) * time.Second
+	until := time.Now().Add(memoryGCBudget)
+	shards := c.loadShards()
+	for i := range shards {
+		s := shards[(c.gcShard+i)%len(shards)]
+		if !s.gc(until) {
+			c.gcShard = (c.gcShard + i) % len(shards)
+			next = memoryGCBudget
+			break
 		}
 	}
+	if c.spill != nil && next != memoryGCBudget {
+		for _, s := range shards {
+			s.pruneSpilled()
+		}
+	}
+	c.pruneLocks(c.clock.Now())
 
-	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+	c.clock.AfterFunc(next, func() { c.startGC() })
 }
 
 // StartAndGC starts GC routine based on config string settings.
+// Items already cached are kept, moved to shards fitting the new limits.
+// Items are loaded from the snapshot file once it is configured,
+// and items in the spill directory can be promoted.
 func (c *MemoryCacher) StartAndGC(opt Options) error {
 	c.lock.Lock()
 	c.interval = opt.Interval
+	if opt.Clock != nil {
+		c.clock = opt.Clock
+	} else if c.clock == nil {
+		c.clock = DefaultClock
+	}
+
+	spill, err := startSpill(opt, c.clock)
+	if err != nil {
+		c.lock.Unlock()
+		return fmt.Errorf("cache/memory: %v", err)
+	}
+
+	n := memoryShardCount(opt.MaxEntries, opt.MaxBytes)
+	shards := newMemoryShards(n, c.clock)
+	if opt.MaxEntries > 0 || opt.MaxBytes > 0 {
+		for _, s := range shards {
+			s.maxEntries = opt.MaxEntries / n
+			s.maxBytes = opt.MaxBytes / int64(n)
+			policy, err := newEvictionPolicy(opt.EvictionPolicy, s.maxEntries)
+			if err != nil {
+				c.lock.Unlock()
+				if spill != nil {
+					spill.stopGC()
+				}
+				return fmt.Errorf("cache/memory: %v", err)
+			}
+			s.policy = policy
+			s.spill = spill
+		}
+	}
+	c.maxEntries = opt.MaxEntries
+	c.maxBytes = opt.MaxBytes
+	if c.spill != nil {
+		c.spill.stopGC()
+	}
+	c.spill = spill
+	if opt.IsolateValues {
+		atomic.StoreInt32(&c.isolate, 1)
+	} else {
+		atomic.StoreInt32(&c.isolate, 0)
+	}
+
+	// Retire old shards while moving their items, operations
+	// waiting for them retry with the new shards once stored.
+	old := c.loadShards()
+	for _, s := range old {
+		s.lock.Lock()
+	}
+	for _, s := range old {
+		shards[0].evictions += s.evictions
+		for key, item := range s.items {
+			shards[fnv32(key)%uint32(n)].set(key, item)
+		}
+		s.retired = true
+	}
+	c.shards.Store(shards)
+	for _, s := range old {
+		s.lock.Unlock()
+	}
+	for _, s := range shards {
+		// Write items evicted while moving.
+		s.lock.Lock()
+		s.unlock()
+	}
+
+	load := len(opt.SnapshotFile) > 0 && opt.SnapshotFile != c.snapshotFile
+	c.stopSnapshots()
+	c.snapshotFile = opt.SnapshotFile
+	c.snapshotInterval = opt.SnapshotInterval
+	c.scheduleSnapshot()
+	clock := c.clock
 	c.lock.Unlock()
 
-	go c.startGC()
+	if spill != nil {
+		if err := c.loadSpilled(spill); err != nil {
+			log.Printf("cache/memory: error loading spilled items: %v", err)
+		}
+	}
+	if load {
+		if n, err := c.loadSnapshot(opt.SnapshotFile, clock.Now()); err != nil {
+			log.Printf("cache/memory: error loading snapshot after %d items: %v", n, err)
+		}
+	}
+
+	clock.AfterFunc(0, func() { c.startGC() })
+	return nil
+}
+
+// now returns the current time of the clock, which StartAndGC may replace.
+func (c *MemoryCacher) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.clock.Now()
+}
+
+// memoryLock represents a lock held in a MemoryCacher.
+type memoryLock struct {
+	token   int64
+	expires time.Time
+}
+
+// memoryLocks keeps locks of a MemoryCacher, fencing tokens survive Flush.
+// Expired locks are dropped by GC.
+type memoryLocks struct {
+	lock   sync.Mutex
+	held   map[string]*memoryLock
+	fences map[string]int64
+}
+
+// Lock acquires the lock of given key that expires after ttl,
+// it returns ErrLockHeld if the lock is held by another owner.
+func (c *MemoryCacher) Lock(key string, ttl time.Duration) (Lock, error) {
+	now := c.now()
+	c.locks.lock.Lock()
+	defer c.locks.lock.Unlock()
+
+	if l, ok := c.locks.held[key]; ok && now.Before(l.expires) {
+		return nil, ErrLockHeld
+	}
+	if c.locks.held == nil {
+		c.locks.held = make(map[string]*memoryLock)
+		c.locks.fences = make(map[string]int64)
+	}
+
+	c.locks.fences[key]++
+	token := c.locks.fences[key]
+	c.locks.held[key] = &memoryLock{
+		token:   token,
+		expires: now.Add(ttl),
+	}
+	return NewLock(token, func() error {
+		return c.updateLock(key, token, func(*memoryLock, time.Time) {
+			delete(c.locks.held, key)
+		})
+	}, func(ttl time.Duration) error {
+		return c.updateLock(key, token, func(l *memoryLock, now time.Time) {
+			l.expires = now.Add(ttl)
+		})
+	}), nil
+}
+
+// updateLock calls fn with the lock of given key and the current time
+// with locks held, it returns ErrLockLost if the lock is not held anymore.
+func (c *MemoryCacher) updateLock(key string, token int64, fn func(l *memoryLock, now time.Time)) error {
+	now := c.now()
+	c.locks.lock.Lock()
+	defer c.locks.lock.Unlock()
+
+	l, ok := c.locks.held[key]
+	if !ok || l.token != token || !now.Before(l.expires) {
+		return ErrLockLost
+	}
+	fn(l, now)
 	return nil
 }
 
+// pruneLocks drops expired locks, fencing tokens are kept.
+func (c *MemoryCacher) pruneLocks(now time.Time) {
+	c.locks.lock.Lock()
+	defer c.locks.lock.Unlock()
+
+	for key, l := range c.locks.held {
+		if !now.Before(l.expires) {
+			delete(c.locks.held, key)
+		}
+	}
+}
+
 func init() {
 	Register("memory", NewMemoryCacher())
 }
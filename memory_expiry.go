@@ -0,0 +1,104 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	// Maximum time a GC pass of the memory adapter spends deleting expired items,
+	// the pass continues after a pause of the same length if it runs out of time.
+	memoryGCBudget = 5 * time.Millisecond
+	// Number of items deleted between checks of the GC budget.
+	memoryGCBatch = 64
+	// Maximum number of expired items deleted by each write, so that
+	// memory is reclaimed between GC passes without slowing writes down.
+	memoryWriteExpire = 2
+)
+
+// expiryHeap is a min-heap of items that expire, ordered by the Unix time they expire at.
+type expiryHeap []*MemoryItem
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline() < h[j].deadline() }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*MemoryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
+
+// schedule tracks expiration of the item if it expires.
+// It must be called with the lock held.
+func (s *memoryShard) schedule(item *MemoryItem) {
+	item.index = -1
+	if item.expire > 0 {
+		heap.Push(&s.expiry, item)
+	}
+}
+
+// unschedule stops tracking expiration of the item.
+// It must be called with the lock held.
+func (s *memoryShard) unschedule(item *MemoryItem) {
+	if item.index >= 0 {
+		heap.Remove(&s.expiry, item.index)
+	}
+}
+
+// expireDue deletes up to limit items that have expired by now, or all
+// of them if limit is negative. It returns true if no expired item is left.
+// It must be called with the lock held.
+func (s *memoryShard) expireDue(now time.Time, limit int) bool {
+	for ; limit != 0; limit-- {
+		if len(s.expiry) == 0 || s.expiry[0].deadline() > now.Unix() {
+			return true
+		}
+		s.remove(s.expiry[0].key, s.expiry[0])
+	}
+	return false
+}
+
+// gc deletes expired items of the shard until given time, in batches so that
+// other operations do not wait for long. It returns true if no expired item is left.
+func (s *memoryShard) gc(until time.Time) bool {
+	for {
+		s.lock.Lock()
+		done := s.expireDue(s.clock.Now(), memoryGCBatch)
+		s.lock.Unlock()
+		if done {
+			return true
+		} else if !time.Now().Before(until) {
+			return false
+		}
+	}
+}
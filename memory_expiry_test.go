@@ -0,0 +1,88 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MemoryExpiry(t *testing.T) {
+	Convey("Track expiration of memory cache items", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{Interval: 60, MaxEntries: 100, Clock: clock}), ShouldBeNil)
+		s := c.loadShards()[0]
+
+		for i, expire := range []int64{30, 10, 0, 20} {
+			So(c.Put(strconv.Itoa(i), i, expire), ShouldBeNil)
+		}
+		So(s.expiry, ShouldHaveLength, 3)
+		So(s.expiry[0].key, ShouldEqual, "1")
+
+		Convey("Delete only due items", func() {
+			s.lock.Lock()
+			So(s.expireDue(clock.Now().Add(15*time.Second), -1), ShouldBeTrue)
+			s.lock.Unlock()
+			So(c.Stats()["items"], ShouldEqual, 3)
+			So(s.expiry, ShouldHaveLength, 2)
+			So(s.expiry[0].key, ShouldEqual, "3")
+		})
+
+		Convey("Stop tracking deleted and replaced items", func() {
+			So(c.Delete("1"), ShouldBeNil)
+			So(c.Put("0", 0, 0), ShouldBeNil)
+			So(c.Put("2", 2, 5), ShouldBeNil)
+			So(s.expiry, ShouldHaveLength, 2)
+			So(s.expiry[0].key, ShouldEqual, "2")
+
+			So(c.Flush(), ShouldBeNil)
+			So(s.expiry, ShouldBeEmpty)
+		})
+
+		Convey("Reclaim expired items on writes", func() {
+			clock.Advance(25 * time.Second)
+			So(c.Put("4", 4, 0), ShouldBeNil)
+			So(c.Stats()["items"], ShouldEqual, 3)
+			So(s.expiry, ShouldHaveLength, 1)
+		})
+
+		Convey("Reclaim expired items by GC", func() {
+			clock.Advance(time.Minute)
+			So(c.Stats()["items"], ShouldEqual, 1)
+			So(s.expiry, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Bound GC passes by time budget", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{Interval: -1, MaxEntries: 1000, Clock: clock}), ShouldBeNil)
+		s := c.loadShards()[0]
+		for i := 0; i < 3*memoryGCBatch; i++ {
+			So(c.Put(strconv.Itoa(i), i, 1), ShouldBeNil)
+		}
+		clock.Advance(time.Second)
+
+		// A budget that has run out still lets a pass delete a batch.
+		So(s.gc(time.Now()), ShouldBeFalse)
+		So(c.Stats()["items"], ShouldEqual, 2*memoryGCBatch)
+		So(s.gc(time.Now().Add(time.Minute)), ShouldBeTrue)
+		So(c.Stats()["items"], ShouldEqual, 0)
+	})
+}
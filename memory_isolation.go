@@ -0,0 +1,89 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cloner is implemented by values that can deep-copy themselves. The memory
+// adapter copies such values by Clone when Options.IsolateValues is set.
+type Cloner interface {
+	Clone() interface{}
+}
+
+// gobValue is a value stored encoded by EncodeGob.
+type gobValue []byte
+
+// Size returns size of the encoded value, which is also its size in an export.
+func (v gobValue) Size() int64 {
+	return int64(len(v))
+}
+
+// isImmutable returns true if given value cannot be changed through a copy of it.
+func isImmutable(val interface{}) bool {
+	switch val.(type) {
+	case nil, string, bool,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, uintptr,
+		float32, float64, complex64, complex128,
+		time.Time:
+		return true
+	}
+	return false
+}
+
+// isolate returns the form of given value to store, so that the caller
+// mutating the value afterwards does not change the stored one.
+func isolate(val interface{}) (interface{}, error) {
+	if isImmutable(val) {
+		return val, nil
+	}
+	switch v := val.(type) {
+	case Cloner:
+		return v.Clone(), nil
+	case []byte:
+		return append([]byte(nil), v...), nil
+	}
+
+	data, err := EncodeGob(&Item{Val: val})
+	if err != nil {
+		return nil, fmt.Errorf("cache/memory: error isolating value of type %T: %v", val, err)
+	}
+	return gobValue(data), nil
+}
+
+// unisolate returns a copy of the stored value for the caller to own.
+// Values stored encoded are decoded whether isolation is still enabled or not.
+func unisolate(val interface{}, isolated bool) (interface{}, error) {
+	if v, ok := val.(gobValue); ok {
+		item := new(Item)
+		if err := DecodeGob(v, item); err != nil {
+			return nil, err
+		}
+		return item.Val, nil
+	}
+	if !isolated || isImmutable(val) {
+		return val, nil
+	}
+	switch v := val.(type) {
+	case Cloner:
+		return v.Clone(), nil
+	case []byte:
+		return append([]byte(nil), v...), nil
+	}
+	return val, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"encoding/gob"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type clonedList struct {
+	items  []string
+	clones *int32
+}
+
+func (l *clonedList) Clone() interface{} {
+	*l.clones++
+	return &clonedList{
+		items:  append([]string(nil), l.items...),
+		clones: l.clones,
+	}
+}
+
+func Test_MemoryIsolation(t *testing.T) {
+	gob.Register(map[string]int{})
+
+	Convey("Isolate values of memory cache", t, func() {
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{IsolateValues: true}), ShouldBeNil)
+
+		Convey("Copy values through encoding", func() {
+			m := map[string]int{"a": 1}
+			So(c.Put("map", m, 0), ShouldBeNil)
+			m["a"] = 2
+
+			got := c.Get("map").(map[string]int)
+			So(got["a"], ShouldEqual, 1)
+			got["a"] = 3
+			So(c.Get("map").(map[string]int)["a"], ShouldEqual, 1)
+
+			b := []byte("macaron")
+			So(c.Put("bytes", b, 0), ShouldBeNil)
+			b[0] = 'M'
+			So(string(c.Get("bytes").([]byte)), ShouldEqual, "macaron")
+
+			So(c.Put("func", func() {}, 0), ShouldNotBeNil)
+		})
+
+		Convey("Copy values by Clone", func() {
+			var clones int32
+			l := &clonedList{items: []string{"a"}, clones: &clones}
+			So(c.Put("list", l, 0), ShouldBeNil)
+			l.items[0] = "b"
+
+			got := c.Get("list").(*clonedList)
+			So(got.items, ShouldResemble, []string{"a"})
+			So(got, ShouldNotPointTo, c.Get("list"))
+			So(clones, ShouldEqual, 3)
+		})
+
+		Convey("Keep counters and immutable values as they are", func() {
+			So(c.Put("count", 1, 0), ShouldBeNil)
+			So(c.Incr("count"), ShouldBeNil)
+			So(c.Get("count"), ShouldEqual, 2)
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+		})
+
+		Convey("Decode values after isolation is disabled", func() {
+			So(c.Put("map", map[string]int{"a": 1}, 0), ShouldBeNil)
+			So(c.StartAndGC(Options{}), ShouldBeNil)
+			So(c.Get("map"), ShouldResemble, map[string]int{"a": 1})
+
+			e, ok := c.Inspect("map")
+			So(ok, ShouldBeTrue)
+			So(e.Size, ShouldEqual, EncodedSize(map[string]int{"a": 1}))
+		})
+
+		Convey("Mutate values concurrently", func() {
+			So(c.Put("map", map[string]int{"a": 0}, 0), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						m := c.Get("map").(map[string]int)
+						m["a"] = i
+						m[string(rune('b'+i))] = j
+						if j%10 == 0 {
+							_ = c.Put("map", m, 0)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			So(c.Get("map"), ShouldNotBeNil)
+		})
+	})
+}
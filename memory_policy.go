@@ -0,0 +1,457 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+)
+
+// EvictionPolicy represents a policy the memory adapter evicts items by
+// when it is bounded by Options.MaxEntries or Options.MaxBytes.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used item.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used item, ties are broken by recency.
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictTinyLFU keeps new items in a small LRU window, and only admits items
+	// leaving the window into the main cache if they have been accessed more
+	// often than the item they would replace, as estimated by a count-min sketch.
+	// It keeps a stable hot set from being flushed by one-off scans.
+	EvictTinyLFU EvictionPolicy = "tinylfu"
+)
+
+// evictionPolicy orders items of a bounded MemoryCacher for eviction.
+// Its methods are called with the lock of the cacher held.
+type evictionPolicy interface {
+	// add records a newly stored key.
+	add(key string)
+	// hit records an access to a stored key.
+	hit(key string)
+	// miss records an access to a key that is not stored.
+	miss(key string)
+	// remove forgets a deleted key.
+	remove(key string)
+	// victim returns the stored key to evict next.
+	victim() string
+	// reset forgets all keys.
+	reset()
+}
+
+// newEvictionPolicy returns the eviction policy of given name for a cache
+// holding about given number of items, 0 if unknown.
+func newEvictionPolicy(name EvictionPolicy, capacity int) (evictionPolicy, error) {
+	switch name {
+	case "", EvictLRU:
+		return newLRUPolicy(), nil
+	case EvictLFU:
+		return newLFUPolicy(), nil
+	case EvictTinyLFU:
+		return newTinyLFUPolicy(capacity), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy '%s'", name)
+}
+
+// lruList is a list of keys ordered by recency, front is the most recently used.
+type lruList struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (l *lruList) len() int {
+	return l.order.Len()
+}
+
+func (l *lruList) push(key string) {
+	l.elems[key] = l.order.PushFront(key)
+}
+
+func (l *lruList) touch(key string) bool {
+	elem, ok := l.elems[key]
+	if ok {
+		l.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (l *lruList) remove(key string) bool {
+	elem, ok := l.elems[key]
+	if ok {
+		l.order.Remove(elem)
+		delete(l.elems, key)
+	}
+	return ok
+}
+
+// back returns the least recently used key, or false if the list is empty.
+func (l *lruList) back() (string, bool) {
+	if l.order.Len() == 0 {
+		return "", false
+	}
+	return l.order.Back().Value.(string), true
+}
+
+func (l *lruList) reset() {
+	l.order.Init()
+	l.elems = make(map[string]*list.Element)
+}
+
+// lruPolicy evicts the least recently used item.
+type lruPolicy struct {
+	*lruList
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{newLRUList()}
+}
+
+func (p *lruPolicy) add(key string)    { p.push(key) }
+func (p *lruPolicy) hit(key string)    { p.touch(key) }
+func (p *lruPolicy) miss(key string)   {}
+func (p *lruPolicy) remove(key string) { p.lruList.remove(key) }
+
+func (p *lruPolicy) victim() string {
+	key, _ := p.back()
+	return key
+}
+
+// lfuEntry is a key in the heap of lfuPolicy.
+type lfuEntry struct {
+	key   string
+	freq  int64
+	used  int64 // Sequence number of the last access.
+	index int
+}
+
+// lfuHeap is a min-heap of keys ordered by frequency and then recency of access.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].used < h[j].used
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used item. Frequencies are counted
+// while items are stored, ties are broken by recency.
+type lfuPolicy struct {
+	heap    lfuHeap
+	entries map[string]*lfuEntry
+	seq     int64
+	last    *lfuEntry // The most recently added entry.
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) add(key string) {
+	p.seq++
+	e := &lfuEntry{key: key, freq: 1, used: p.seq}
+	p.entries[key] = e
+	p.last = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *lfuPolicy) hit(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.seq++
+	e.freq++
+	e.used = p.seq
+	heap.Fix(&p.heap, e.index)
+}
+
+func (p *lfuPolicy) miss(key string) {}
+
+func (p *lfuPolicy) remove(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.heap, e.index)
+	delete(p.entries, key)
+	if p.last == e {
+		p.last = nil
+	}
+}
+
+// victim returns the least frequently used key other than the one just added,
+// which would otherwise always be evicted before it could be accessed again.
+func (p *lfuPolicy) victim() string {
+	if len(p.heap) == 0 {
+		return ""
+	} else if p.heap[0] != p.last || len(p.heap) == 1 {
+		return p.heap[0].key
+	}
+
+	// The next least frequently used key is one of the children of the root.
+	i := 1
+	if len(p.heap) > 2 && p.heap.Less(2, 1) {
+		i = 2
+	}
+	return p.heap[i].key
+}
+
+func (p *lfuPolicy) reset() {
+	p.heap = nil
+	p.entries = make(map[string]*lfuEntry)
+	p.last = nil
+}
+
+const (
+	sketchDepth    = 4
+	sketchMaxCount = 15
+)
+
+// countMinSketch estimates access frequencies of keys with 4-bit counters
+// stored in bytes. Counters are halved periodically so that frequencies
+// reflect recent accesses.
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newCountMinSketch returns a sketch with rows of given width rounded up to a power of 2.
+func newCountMinSketch(width int) *countMinSketch {
+	n := 16
+	for n < width {
+		n <<= 1
+	}
+	s := &countMinSketch{
+		mask:    uint64(n - 1),
+		resetAt: 10 * n,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, n)
+	}
+	return s
+}
+
+func sketchHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// index returns the position of the hash in given row by double hashing.
+func (s *countMinSketch) index(hash uint64, row int) uint64 {
+	return (hash + uint64(row)*(hash>>32|1)) & s.mask
+}
+
+func (s *countMinSketch) increment(key string) {
+	hash := sketchHash(key)
+	for i := range s.rows {
+		if idx := s.index(hash, i); s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	hash := sketchHash(key)
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(hash, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = 0
+		}
+	}
+	s.additions = 0
+}
+
+const (
+	// Percentage of items kept in the admission window.
+	tinyLFUWindowPercent = 1
+	// Percentage of items in the main cache kept in the protected segment.
+	tinyLFUProtectedPercent = 80
+	// Width of the sketch when the number of items is not bounded.
+	tinyLFUDefaultWidth = 1 << 16
+)
+
+// tinyLFUPolicy implements W-TinyLFU. New keys enter an LRU window, keys leaving
+// the window are admitted into the main cache only if they are estimated to be
+// accessed more often than the key they would replace. The main cache is a
+// segmented LRU, keys accessed while in its probation segment are promoted
+// to the protected segment.
+type tinyLFUPolicy struct {
+	sketch    *countMinSketch
+	window    *lruList
+	probation *lruList
+	protected *lruList
+}
+
+func newTinyLFUPolicy(capacity int) *tinyLFUPolicy {
+	width := capacity
+	if width <= 0 {
+		width = tinyLFUDefaultWidth
+	}
+	return &tinyLFUPolicy{
+		sketch:    newCountMinSketch(width),
+		window:    newLRUList(),
+		probation: newLRUList(),
+		protected: newLRUList(),
+	}
+}
+
+func (p *tinyLFUPolicy) len() int {
+	return p.window.len() + p.probation.len() + p.protected.len()
+}
+
+// windowMax returns the number of keys the window should hold.
+func (p *tinyLFUPolicy) windowMax() int {
+	if n := p.len() * tinyLFUWindowPercent / 100; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// add puts the key into the window. Keys leaving the window are moved into
+// the main cache without competing until the cache is full, in which case
+// victim is called and the key leaving the window competes there.
+func (p *tinyLFUPolicy) add(key string) {
+	p.sketch.increment(key)
+	p.window.push(key)
+	for p.window.len() > p.windowMax()+1 {
+		oldest, _ := p.window.back()
+		p.window.remove(oldest)
+		p.probation.push(oldest)
+	}
+}
+
+func (p *tinyLFUPolicy) hit(key string) {
+	p.sketch.increment(key)
+	if p.window.touch(key) || p.protected.touch(key) {
+		return
+	}
+	if !p.probation.remove(key) {
+		return
+	}
+
+	p.protected.push(key)
+	main := p.probation.len() + p.protected.len()
+	if p.protected.len() > main*tinyLFUProtectedPercent/100 {
+		demoted, _ := p.protected.back()
+		p.protected.remove(demoted)
+		p.probation.push(demoted)
+	}
+}
+
+func (p *tinyLFUPolicy) miss(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFUPolicy) remove(key string) {
+	if !p.window.remove(key) && !p.probation.remove(key) {
+		p.protected.remove(key)
+	}
+}
+
+// mainBack returns the least recently used key of the main cache.
+func (p *tinyLFUPolicy) mainBack() (string, bool) {
+	if key, ok := p.probation.back(); ok {
+		return key, true
+	}
+	return p.protected.back()
+}
+
+// victim picks the key to evict. While the window is over its share, the key
+// leaving it competes with the least recently used key of the main cache and
+// the winner stays in the main cache.
+func (p *tinyLFUPolicy) victim() string {
+	for {
+		candidate, ok := p.window.back()
+		if !ok || p.window.len() <= p.windowMax() {
+			if victim, ok := p.mainBack(); ok {
+				return victim
+			}
+			return candidate
+		}
+
+		victim, ok := p.mainBack()
+		if ok && p.sketch.estimate(candidate) <= p.sketch.estimate(victim) {
+			return candidate
+		}
+		p.window.remove(candidate)
+		p.probation.push(candidate)
+		if ok {
+			return victim
+		}
+		// The main cache was empty, so the candidate was admitted without competing.
+	}
+}
+
+func (p *tinyLFUPolicy) reset() {
+	p.sketch.reset()
+	p.window.reset()
+	p.probation.reset()
+	p.protected.reset()
+}
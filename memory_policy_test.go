@@ -0,0 +1,130 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// scanHitRatio returns the hit ratio of a read-through cache using given eviction
+// policy, when a stable hot set is accessed while one-off keys are scanned.
+func scanHitRatio(policy EvictionPolicy) float64 {
+	c := NewMemoryCacher()
+	if err := c.StartAndGC(Options{MaxEntries: 100, EvictionPolicy: policy}); err != nil {
+		panic(err)
+	}
+
+	get := func(key string) {
+		if c.Get(key) == nil {
+			_ = c.Put(key, key, 0)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		get(fmt.Sprintf("scan%d", i))
+		if i%2 == 0 {
+			get(fmt.Sprintf("hot%d", i/2%50))
+		}
+	}
+	return c.HitRatio()
+}
+
+func Test_EvictionPolicy(t *testing.T) {
+	Convey("Evict items by policy", t, func() {
+		Convey("Least frequently used", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{MaxEntries: 2, EvictionPolicy: EvictLFU}), ShouldBeNil)
+
+			So(c.Put("a", 1, 0), ShouldBeNil)
+			So(c.Put("b", 2, 0), ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(c.Get("a"), ShouldEqual, 1)
+			}
+			So(c.Get("b"), ShouldEqual, 2)
+			So(c.Put("c", 3, 0), ShouldBeNil)
+			So(c.IsExist("a"), ShouldBeTrue)
+			So(c.IsExist("b"), ShouldBeFalse)
+
+			// Ties are broken by recency.
+			So(c.Put("d", 4, 0), ShouldBeNil)
+			So(c.IsExist("c"), ShouldBeFalse)
+			So(c.IsExist("d"), ShouldBeTrue)
+		})
+
+		Convey("Keep hot set through scans", func() {
+			lru, tinyLFU := scanHitRatio(EvictLRU), scanHitRatio(EvictTinyLFU)
+			So(lru, ShouldEqual, 0)
+			// Hot keys can at most be hit in 2450 of 7500 accesses.
+			So(tinyLFU, ShouldBeGreaterThan, 0.3)
+		})
+
+		Convey("Admit items accessed more often than the victim", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{MaxEntries: 2, EvictionPolicy: EvictTinyLFU}), ShouldBeNil)
+
+			So(c.Put("a", 1, 0), ShouldBeNil)
+			So(c.Put("b", 2, 0), ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(c.Get("c"), ShouldBeNil)
+			}
+			So(c.Put("c", 3, 0), ShouldBeNil)
+			So(c.IsExist("c"), ShouldBeTrue)
+			So(c.Stats()["items"], ShouldEqual, 2)
+		})
+
+		Convey("Unknown policy", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{MaxEntries: 2, EvictionPolicy: "random"}), ShouldNotBeNil)
+			So(c.StartAndGC(Options{EvictionPolicy: "random"}), ShouldBeNil)
+		})
+	})
+
+	Convey("Report hit ratio", t, func() {
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{}), ShouldBeNil)
+		So(c.HitRatio(), ShouldEqual, 0)
+
+		So(c.Put("a", 1, 0), ShouldBeNil)
+		for _, key := range []string{"a", "a", "a", "b"} {
+			c.Get(key)
+		}
+		So(c.HitRatio(), ShouldEqual, 0.75)
+		stats := c.Stats()
+		So(stats["hits"], ShouldEqual, 3)
+		So(stats["misses"], ShouldEqual, 1)
+	})
+
+	Convey("Estimate frequencies with count-min sketch", t, func() {
+		s := newCountMinSketch(16)
+		for i := 0; i < 20; i++ {
+			s.increment("a")
+		}
+		s.increment("b")
+		So(s.estimate("a"), ShouldEqual, sketchMaxCount)
+		So(s.estimate("b"), ShouldBeGreaterThanOrEqualTo, 1)
+		So(s.estimate("c"), ShouldBeLessThan, sketchMaxCount)
+
+		// Counters are halved after 10 times the width of additions.
+		for i := 0; i < 160; i++ {
+			s.increment(fmt.Sprintf("k%d", i))
+		}
+		So(s.estimate("a"), ShouldBeLessThan, sketchMaxCount)
+
+		s.reset()
+		So(s.estimate("a"), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// snapshotItem is an item copied out of the cache to be saved.
+type snapshotItem struct {
+	key string
+	val interface{}
+	ttl int64
+}
+
+// saveSnapshot atomically writes items that have not expired by now to the
+// snapshot file in the format of Export, with their remaining TTL.
+func (c *MemoryCacher) saveSnapshot(name string, now time.Time) error {
+	var items []snapshotItem
+	for _, s := range c.loadShards() {
+		s.lock.RLock()
+		for key, item := range s.items {
+			if item.hasExpired(now) {
+				continue
+			}
+			var ttl int64
+			if item.expire > 0 {
+				ttl = item.deadline() - now.Unix()
+			}
+			items = append(items, snapshotItem{key, item.val, ttl})
+		}
+		s.lock.RUnlock()
+	}
+
+	return writeFileAtomic(name, true, func(w io.Writer) error {
+		ex, err := newExporter(w, now)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err = ex.write(item.key, item.val, item.ttl); err != nil {
+				return err
+			}
+		}
+		return ex.flush()
+	})
+}
+
+// loadSnapshot puts items that have not expired by now from the snapshot file
+// into the cache, and returns the number of loaded items. A missing file is not an error.
+func (c *MemoryCacher) loadSnapshot(name string, now time.Time) (int, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	im, err := newImporter(f)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		rec, err := im.next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if expire, ok := im.expire(rec, true, now); ok {
+			if err = im.put(c, rec, expire); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// scheduleSnapshot saves a snapshot after the snapshot interval and schedules the next one,
+// until the configuration changes. It must be called with the lock held.
+func (c *MemoryCacher) scheduleSnapshot() {
+	if len(c.snapshotFile) == 0 || c.snapshotInterval < 1 {
+		return
+	}
+
+	gen := c.snapshotGen
+	c.snapshotTimer = c.clock.AfterFunc(time.Duration(c.snapshotInterval)*time.Second, func() {
+		c.lock.Lock()
+		name, now := c.snapshotFile, c.clock.Now()
+		c.lock.Unlock()
+		if err := c.saveSnapshot(name, now); err != nil {
+			log.Printf("cache/memory: error saving snapshot: %v", err)
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if gen == c.snapshotGen {
+			c.scheduleSnapshot()
+		}
+	})
+}
+
+// stopSnapshots stops scheduled snapshots. It must be called with the lock held.
+func (c *MemoryCacher) stopSnapshots() {
+	c.snapshotGen++
+	if c.snapshotTimer != nil {
+		c.snapshotTimer.Stop()
+		c.snapshotTimer = nil
+	}
+}
+
+// Close stops GC and scheduled snapshots, and saves the items that have
+// not expired to the snapshot file if one is configured.
+func (c *MemoryCacher) Close() error {
+	c.lock.Lock()
+	c.interval = 0
+	if c.spill != nil {
+		c.spill.stopGC()
+	}
+	c.stopSnapshots()
+	name, now := c.snapshotFile, c.clock.Now()
+	c.lock.Unlock()
+
+	if len(name) == 0 {
+		return nil
+	}
+	return c.saveSnapshot(name, now)
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MemorySnapshot(t *testing.T) {
+	Convey("Persist memory cache across restarts", t, func() {
+		dir, err := ioutil.TempDir("", "macaron-cache")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, "snapshots", "memory.json")
+
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		opt := Options{Interval: -1, Clock: clock, SnapshotFile: name}
+		c := NewMemoryCacher()
+		So(c.StartAndGC(opt), ShouldBeNil)
+		So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+		So(c.Put("data", []byte("macaron"), 10), ShouldBeNil)
+		So(c.Put("count", 42, 20), ShouldBeNil)
+		So(c.Put("gone", "soon", 1), ShouldBeNil)
+		clock.Advance(time.Second)
+
+		Convey("Save on close and reload", func() {
+			So(c.Close(), ShouldBeNil)
+			data, err := ioutil.ReadFile(name)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldStartWith, `{"format":"macaron-cache","version":1,`)
+			So(string(data), ShouldNotContainSubstring, "gone")
+
+			clock.Advance(14 * time.Second)
+			c2 := NewMemoryCacher()
+			So(c2.StartAndGC(opt), ShouldBeNil)
+			So(c2.Get("uname"), ShouldEqual, "unknwon")
+			So(c2.Get("data"), ShouldBeNil)
+			So(c2.Get("count"), ShouldEqual, 42)
+
+			e, ok := c2.Inspect("count")
+			So(ok, ShouldBeTrue)
+			So(e.TTL(clock.Now()), ShouldEqual, 5*time.Second)
+			e, ok = c2.Inspect("uname")
+			So(ok, ShouldBeTrue)
+			So(e.Expires.IsZero(), ShouldBeTrue)
+
+			// Snapshots are only loaded once.
+			So(c2.Delete("uname"), ShouldBeNil)
+			So(c2.StartAndGC(opt), ShouldBeNil)
+			So(c2.IsExist("uname"), ShouldBeFalse)
+		})
+
+		Convey("Save on a schedule", func() {
+			opt.SnapshotInterval = 30
+			So(c.StartAndGC(opt), ShouldBeNil)
+			clock.Advance(29 * time.Second)
+			_, err := os.Stat(name)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			clock.Advance(time.Second)
+			data, err := ioutil.ReadFile(name)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "uname")
+
+			So(c.Put("later", "value", 0), ShouldBeNil)
+			clock.Advance(30 * time.Second)
+			data, err = ioutil.ReadFile(name)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "later")
+
+			So(os.Remove(name), ShouldBeNil)
+			So(c.StartAndGC(Options{Interval: -1, Clock: clock}), ShouldBeNil)
+			clock.Advance(time.Minute)
+			_, err = os.Stat(name)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Ignore missing and broken snapshots", func() {
+			So(c.Close(), ShouldBeNil)
+			c2 := NewMemoryCacher()
+			So(c2.StartAndGC(Options{Interval: -1, SnapshotFile: filepath.Join(dir, "missing")}), ShouldBeNil)
+
+			So(ioutil.WriteFile(name, []byte(`{"format":"macaron-cache","version":99}`), 0644), ShouldBeNil)
+			So(c2.StartAndGC(opt), ShouldBeNil)
+			So(c2.Stats()["items"], ShouldEqual, 0)
+		})
+	})
+
+	Convey("Write files atomically", t, func() {
+		dir, err := ioutil.TempDir("", "macaron-cache")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, "file")
+
+		So(writeFileAtomic(name, true, func(w io.Writer) error {
+			_, err := io.WriteString(w, "old")
+			return err
+		}), ShouldBeNil)
+		So(writeFileAtomic(name, true, func(w io.Writer) error {
+			_, _ = io.WriteString(w, "new")
+			return errors.New("disk full")
+		}), ShouldNotBeNil)
+
+		data, err := ioutil.ReadFile(name)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "old")
+		files, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(files, ShouldHaveLength, 1)
+		So(strings.Contains(files[0].Name(), ".tmp"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// spillDeadline returns the Unix time an item spilled with given times
+// expires at, or 0 if it does not expire.
+func spillDeadline(created, expire int64) int64 {
+	if expire <= 0 {
+		return 0
+	}
+	return created + expire
+}
+
+// spilledItem represents an item evicted to the spill directory.
+type spilledItem struct {
+	item     *MemoryItem // Kept until its file is written, so that it can be promoted meanwhile.
+	deadline int64       // Unix time it expires at, 0 if it does not.
+}
+
+// spillItem records the evicted item by given key as spilled, its file is written
+// once the lock is released by unlock. It must be called with the lock held.
+func (s *memoryShard) spillItem(key string, item *MemoryItem) {
+	if s.spill == nil || item.hasExpired(s.clock.Now()) {
+		return
+	}
+	s.spilled[key] = &spilledItem{item, spillDeadline(item.created, item.expire)}
+	s.pending = append(s.pending, key)
+	s.spills++
+}
+
+// hasSpilled returns true if the item by given key has been spilled and has not expired.
+// It must be called with the lock held.
+func (s *memoryShard) hasSpilled(key string, now time.Time) bool {
+	e, ok := s.spilled[key]
+	return ok && (e.deadline == 0 || now.Unix() < e.deadline)
+}
+
+// unspill forgets the spilled item by given key, if any, its file is deleted
+// once the lock is released by unlock. It must be called with the lock held.
+func (s *memoryShard) unspill(key string) {
+	if _, ok := s.spilled[key]; !ok {
+		return
+	}
+	delete(s.spilled, key)
+	s.pending = append(s.pending, key)
+}
+
+// unlock releases the write lock and then writes or deletes the spill files
+// of keys changed while it was held, so that disk I/O does not block the shard.
+func (s *memoryShard) unlock() {
+	pending := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+	for _, key := range pending {
+		s.syncSpill(key)
+	}
+}
+
+// syncSpill writes or deletes the spill file of given key to match the shard.
+// Spill files of a key are only changed here with its key lock of the spill
+// directory held, and every change of the shard is followed by a call,
+// so the file ends up matching the last state of the key.
+func (s *memoryShard) syncSpill(key string) {
+	lock := s.spill.locks.get(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	s.lock.Lock()
+	e := s.spilled[key]
+	var item *Item
+	if e != nil && e.item != nil {
+		item = &Item{
+			Val:     e.item.val,
+			Created: e.item.created,
+			Expire:  e.item.expire,
+			Key:     key,
+		}
+	}
+	s.lock.Unlock()
+	if e == nil {
+		s.removeSpilled(key)
+		return
+	} else if item == nil {
+		// The file has already been written.
+		return
+	}
+
+	// Values stored encoded by isolation are spilled decoded,
+	// so that their files can be read by the file adapter.
+	val, err := unisolate(item.Val, false)
+	if err == nil {
+		item.Val = val
+		err = s.spill.write(item)
+	}
+
+	s.lock.Lock()
+	current := s.spilled[key]
+	if current == e {
+		if err != nil {
+			delete(s.spilled, key)
+		} else {
+			e.item = nil
+		}
+	}
+	s.lock.Unlock()
+	if err != nil {
+		log.Printf("cache/memory: error spilling '%s': %v", key, err)
+	}
+	if current == nil {
+		// Flush has forgotten the item while it was written.
+		s.removeSpilled(key)
+	}
+}
+
+// removeSpilled deletes the spill file of given key, if any.
+func (s *memoryShard) removeSpilled(key string) {
+	if err := os.Remove(s.spill.filepath(key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("cache/memory: error deleting spilled '%s': %v", key, err)
+	}
+}
+
+// pruneSpilled forgets spilled items that have expired, whose files are
+// deleted by GC of the spill directory.
+func (s *memoryShard) pruneSpilled() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now().Unix()
+	for key, e := range s.spilled {
+		if e.deadline > 0 && now >= e.deadline {
+			delete(s.spilled, key)
+		}
+	}
+}
+
+// readSpilled reads the spill file of given key, it returns nil if the file
+// cannot be read or the item has expired.
+func (c *MemoryCacher) readSpilled(s *memoryShard, key string) *MemoryItem {
+	spilled, err := s.spill.read(key)
+	if err != nil || spilled.Key != key || spilled.hasExpired(s.clock.Now()) {
+		return nil
+	}
+
+	val := spilled.Val
+	if c.isolated() {
+		if val, err = isolate(val); err != nil {
+			log.Printf("cache/memory: error promoting '%s': %v", key, err)
+			return nil
+		}
+	}
+	return &MemoryItem{
+		val:     val,
+		created: spilled.Created,
+		expire:  spilled.Expire,
+	}
+}
+
+// lookup returns the item by given key with its shard locked for writing,
+// promoting the item back into the shard if it has been spilled. Spill files
+// are read with the lock released, the caller must release it by unlock.
+func (c *MemoryCacher) lookup(key string) (*memoryShard, *MemoryItem, bool) {
+	s := c.shard(key)
+	for {
+		if item, ok := s.items[key]; ok {
+			return s, item, true
+		}
+		e, ok := s.spilled[key]
+		if !ok {
+			return s, nil, false
+		}
+
+		item := e.item
+		if item == nil {
+			s.unlock()
+			item = c.readSpilled(s, key)
+			s = c.shard(key)
+			if s.spilled[key] != e {
+				// The key has changed meanwhile.
+				continue
+			}
+		}
+
+		s.unspill(key)
+		if item == nil || item.hasExpired(s.clock.Now()) {
+			return s, nil, false
+		}
+		s.set(key, item)
+		s.promotions++
+		return s, item, true
+	}
+}
+
+// startSpill returns the file cacher items evicted by a cache with given
+// options are spilled to, or nil if they are not spilled.
+func startSpill(opt Options, clock Clock) (*FileCacher, error) {
+	if len(opt.SpillDir) == 0 || (opt.MaxEntries <= 0 && opt.MaxBytes <= 0) {
+		return nil, nil
+	}
+	spill := NewFileCacher()
+	return spill, spill.StartAndGC(Options{
+		AdapterConfig: opt.SpillDir,
+		Interval:      opt.Interval,
+		FileSync:      opt.FileSync,
+		Clock:         clock,
+	})
+}
+
+// loadSpilled registers items already in the spill directory, so that
+// items spilled before StartAndGC can still be promoted.
+func (c *MemoryCacher) loadSpilled(spill *FileCacher) error {
+	return spill.Scan(func(e Entry) bool {
+		s := c.shard(e.Key)
+		if _, ok := s.items[e.Key]; !ok && s.spill == spill {
+			spilled := new(spilledItem)
+			if !e.Expires.IsZero() {
+				spilled.deadline = e.Expires.Unix()
+			}
+			s.spilled[e.Key] = spilled
+		}
+		s.lock.Unlock()
+		return true
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MemorySpill(t *testing.T) {
+	Convey("Spill evicted items of memory cache to disk", t, func() {
+		dir, err := ioutil.TempDir("", "macaron-cache")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		opt := Options{Interval: 60, Clock: clock, MaxEntries: 2, SpillDir: dir}
+		c := NewMemoryCacher()
+		So(c.StartAndGC(opt), ShouldBeNil)
+		So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+		So(c.Put("count", 1, 10), ShouldBeNil)
+		So(c.Put("data", []byte("macaron"), 0), ShouldBeNil)
+
+		stats := c.Stats()
+		So(stats["items"], ShouldEqual, 2)
+		So(stats["evictions"], ShouldEqual, 1)
+		So(stats["spills"], ShouldEqual, 1)
+		So(stats["spilled"], ShouldEqual, 1)
+
+		Convey("Keep the spilled format of the file adapter", func() {
+			f := NewFileCacher()
+			So(f.StartAndGC(Options{AdapterConfig: dir, Interval: -1, Clock: clock}), ShouldBeNil)
+			So(f.Get("uname"), ShouldEqual, "unknwon")
+		})
+
+		Convey("Promote spilled items on Get", func() {
+			So(c.IsExist("uname"), ShouldBeTrue)
+			e, ok := c.Inspect("uname")
+			So(ok, ShouldBeTrue)
+			So(e.Expires.IsZero(), ShouldBeTrue)
+
+			So(c.Get("uname"), ShouldEqual, "unknwon")
+			stats := c.Stats()
+			So(stats["items"], ShouldEqual, 2)
+			So(stats["promotions"], ShouldEqual, 1)
+			So(stats["spills"], ShouldEqual, 2)
+			So(stats["hits"], ShouldEqual, 1)
+
+			// Promoted items are no longer on disk.
+			_, err := os.Stat(c.spill.filepath("uname"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			// Counters are promoted to be updated.
+			So(c.Incr("count"), ShouldBeNil)
+			So(c.Get("count"), ShouldEqual, 2)
+		})
+
+		Convey("Keep expiration of spilled items", func() {
+			So(c.Put("other", "value", 0), ShouldBeNil)
+			So(c.Stats()["spilled"], ShouldEqual, 2)
+			clock.Advance(5 * time.Second)
+			e, ok := c.Inspect("count")
+			So(ok, ShouldBeTrue)
+			So(e.TTL(clock.Now()), ShouldEqual, 5*time.Second)
+
+			clock.Advance(5 * time.Second)
+			So(c.IsExist("count"), ShouldBeFalse)
+			So(c.Get("count"), ShouldBeNil)
+
+			clock.Advance(time.Minute)
+			So(c.Stats()["spilled"], ShouldEqual, 1)
+		})
+
+		Convey("Delete spilled items", func() {
+			So(c.Delete("uname"), ShouldBeNil)
+			So(c.IsExist("uname"), ShouldBeFalse)
+
+			So(c.Put("other", "value", 0), ShouldBeNil)
+			So(c.Stats()["spilled"], ShouldEqual, 1)
+			So(c.Flush(), ShouldBeNil)
+			So(c.Stats()["spilled"], ShouldEqual, 0)
+			So(c.IsExist("uname"), ShouldBeFalse)
+		})
+
+		Convey("Scan spilled items", func() {
+			var keys []string
+			So(c.Scan(func(e Entry) bool {
+				keys = append(keys, e.Key)
+				return true
+			}), ShouldBeNil)
+			So(keys, ShouldHaveLength, 3)
+		})
+
+		Convey("Write spill files without the shard locked", func() {
+			// Holding the key locks of the spill directory stalls writing files.
+			for i := range c.spill.locks {
+				c.spill.locks[i].Lock()
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = c.Put("other", "value", 0)
+			}()
+			for c.Stats()["spills"] < 2 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// The shard is not locked and the evicted item is kept until written.
+			for _, key := range []string{"uname", "count", "data", "other"} {
+				So(c.IsExist(key), ShouldBeTrue)
+				_, ok := c.Inspect(key)
+				So(ok, ShouldBeTrue)
+			}
+
+			for i := range c.spill.locks {
+				c.spill.locks[i].Unlock()
+			}
+			<-done
+			So(c.Stats()["spilled"], ShouldEqual, 2)
+			var n int
+			So(c.spill.Scan(func(Entry) bool {
+				n++
+				return true
+			}), ShouldBeNil)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("Sync spill files with FileSync", func() {
+			So(c.spill.sync, ShouldBeFalse)
+			opt.FileSync = true
+			So(c.StartAndGC(opt), ShouldBeNil)
+			So(c.spill.sync, ShouldBeTrue)
+		})
+
+		Convey("Promote items spilled before restarting", func() {
+			c2 := NewMemoryCacher()
+			So(c2.StartAndGC(opt), ShouldBeNil)
+			So(c2.Stats()["spilled"], ShouldEqual, 1)
+			So(c2.Get("uname"), ShouldEqual, "unknwon")
+		})
+	})
+}
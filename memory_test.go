@@ -15,7 +15,10 @@
 package cache
 
 import (
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -27,3 +30,217 @@ func Test_MemoryCacher(t *testing.T) {
 		})
 	})
 }
+
+func Test_MemoryCacher_Clock(t *testing.T) {
+	Convey("Expire items with fake clock", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		c := NewMemoryCacher()
+		So(c.StartAndGC(Options{Interval: 60, Clock: clock}), ShouldBeNil)
+
+		So(c.Put("uname", "unknwon", 10), ShouldBeNil)
+		clock.Advance(9 * time.Second)
+		So(c.Get("uname"), ShouldEqual, "unknwon")
+		clock.Advance(time.Second)
+		So(c.IsExist("uname"), ShouldBeFalse)
+		So(c.Get("uname"), ShouldBeNil)
+
+		So(c.Put("uname", "unknwon", 10), ShouldBeNil)
+		clock.Advance(time.Minute)
+		So(c.Stats()["items"], ShouldEqual, 0)
+	})
+}
+
+type sizedValue int64
+
+func (v sizedValue) Size() int64 { return int64(v) }
+
+func Test_MemoryCacher_Bounded(t *testing.T) {
+	Convey("Evict least recently used items", t, func() {
+		c := NewMemoryCacher()
+
+		Convey("Limit number of entries", func() {
+			So(c.StartAndGC(Options{MaxEntries: 2}), ShouldBeNil)
+
+			So(c.Put("a", "1", 0), ShouldBeNil)
+			So(c.Put("b", "2", 0), ShouldBeNil)
+			So(c.Get("a"), ShouldEqual, "1")
+			So(c.Put("c", "3", 0), ShouldBeNil)
+
+			So(c.IsExist("a"), ShouldBeTrue)
+			So(c.IsExist("b"), ShouldBeFalse)
+			So(c.IsExist("c"), ShouldBeTrue)
+
+			_, err := c.IncrBy("d", 1, 0)
+			So(err, ShouldBeNil)
+			So(c.IsExist("a"), ShouldBeFalse)
+
+			stats := c.Stats()
+			So(stats["items"], ShouldEqual, 2)
+			So(stats["evictions"], ShouldEqual, 2)
+			So(stats["max_entries"], ShouldEqual, 2)
+		})
+
+		Convey("Limit total size", func() {
+			So(c.StartAndGC(Options{MaxBytes: 100}), ShouldBeNil)
+
+			So(c.Put("a", sizedValue(40), 0), ShouldBeNil)
+			So(c.Put("b", sizedValue(40), 0), ShouldBeNil)
+			So(c.Stats()["bytes"], ShouldEqual, 82)
+
+			// Replacing a value does not count as eviction.
+			So(c.Put("b", sizedValue(50), 0), ShouldBeNil)
+			So(c.Stats()["bytes"], ShouldEqual, 92)
+
+			So(c.Put("c", sizedValue(20), 0), ShouldBeNil)
+			So(c.IsExist("a"), ShouldBeFalse)
+			So(c.Stats()["bytes"], ShouldEqual, 72)
+
+			So(c.Delete("b"), ShouldBeNil)
+			So(c.Stats()["bytes"], ShouldEqual, 21)
+
+			// A value larger than the limit is not kept.
+			So(c.Put("d", sizedValue(200), 0), ShouldBeNil)
+			So(c.IsExist("d"), ShouldBeFalse)
+			So(c.IsExist("c"), ShouldBeTrue)
+
+			stats := c.Stats()
+			So(stats["evictions"], ShouldEqual, 2)
+			So(stats["max_bytes"], ShouldEqual, 100)
+
+			So(c.Flush(), ShouldBeNil)
+			So(c.Stats()["bytes"], ShouldEqual, 0)
+		})
+
+		Convey("Estimate size of values", func() {
+			So(sizeOf("unknwon"), ShouldEqual, 7)
+			So(sizeOf([]byte("macaron")), ShouldEqual, 7)
+			So(sizeOf(sizedValue(42)), ShouldEqual, 42)
+			So(sizeOf(123), ShouldEqual, EncodedSize(123))
+			So(sizeOf(func() {}), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Evict items over limits set later", func() {
+			So(c.StartAndGC(Options{}), ShouldBeNil)
+			for _, key := range []string{"a", "b", "c"} {
+				So(c.Put(key, key, 0), ShouldBeNil)
+			}
+			So(c.StartAndGC(Options{MaxEntries: 1}), ShouldBeNil)
+			So(c.Stats()["items"], ShouldEqual, 1)
+			So(c.Stats()["evictions"], ShouldEqual, 2)
+		})
+	})
+}
+
+func Test_MemoryCacher_Shards(t *testing.T) {
+	Convey("Spread items over shards", t, func() {
+		Convey("Number of shards", func() {
+			So(memoryShardCount(0, 0), ShouldEqual, memoryShards)
+			So(memoryShardCount(2, 0), ShouldEqual, 1)
+			So(memoryShardCount(4096, 0), ShouldEqual, 4)
+			So(memoryShardCount(1<<20, 0), ShouldEqual, memoryShards)
+			So(memoryShardCount(0, 4<<20), ShouldEqual, 4)
+			So(memoryShardCount(1<<20, 4<<20), ShouldEqual, 4)
+		})
+
+		Convey("Keep items when limits change", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{}), ShouldBeNil)
+			So(c.Stats()["shards"], ShouldEqual, memoryShards)
+			for i := 0; i < 100; i++ {
+				So(c.Put(strconv.Itoa(i), i, 0), ShouldBeNil)
+			}
+
+			So(c.StartAndGC(Options{MaxEntries: 2048}), ShouldBeNil)
+			So(c.Stats()["shards"], ShouldEqual, 2)
+			for i := 0; i < 100; i++ {
+				So(c.Get(strconv.Itoa(i)), ShouldEqual, i)
+			}
+		})
+
+		Convey("Bound sharded cache", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{MaxEntries: 4096}), ShouldBeNil)
+			for i := 0; i < 10000; i++ {
+				So(c.Put(strconv.Itoa(i), i, 0), ShouldBeNil)
+			}
+
+			stats := c.Stats()
+			So(stats["items"], ShouldBeLessThanOrEqualTo, 4096)
+			So(stats["items"]+stats["evictions"], ShouldEqual, 10000)
+		})
+
+		Convey("Count concurrently", func() {
+			c := NewMemoryCacher()
+			So(c.StartAndGC(Options{}), ShouldBeNil)
+			So(c.Put("shared", 0, 0), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					own := "own" + strconv.Itoa(i)
+					for j := 0; j < 100; j++ {
+						_ = c.Incr("shared")
+						_, _ = c.IncrBy(own, 1, 0)
+						c.Get("shared")
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			So(c.Get("shared"), ShouldEqual, 1600)
+			for i := 0; i < 16; i++ {
+				So(c.Get("own"+strconv.Itoa(i)), ShouldEqual, 100)
+			}
+		})
+	})
+}
+
+func benchmarkMemoryCacher(b *testing.B, opt Options, writePercent int) {
+	c := NewMemoryCacher()
+	if err := c.StartAndGC(opt); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkCache(b, c, writePercent)
+}
+
+// benchmarkCache runs gets and given percentage of puts on 10000 keys in parallel.
+func benchmarkCache(b *testing.B, c Cache, writePercent int) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		_ = c.Put(keys[i], i, 0)
+	}
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%100 < writePercent {
+				_ = c.Put(key, i, 0)
+			} else {
+				c.Get(key)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkMemoryCacher_Get(b *testing.B) {
+	benchmarkMemoryCacher(b, Options{}, 0)
+}
+
+func BenchmarkMemoryCacher_Put(b *testing.B) {
+	benchmarkMemoryCacher(b, Options{}, 100)
+}
+
+func BenchmarkMemoryCacher_Mixed(b *testing.B) {
+	benchmarkMemoryCacher(b, Options{}, 10)
+}
+
+func BenchmarkMemoryCacher_MixedBounded(b *testing.B) {
+	benchmarkMemoryCacher(b, Options{MaxEntries: 1 << 16}, 10)
+}
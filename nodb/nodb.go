@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/lunny/nodb"
 	"github.com/lunny/nodb/config"
@@ -36,6 +37,7 @@ type NodbCacher struct {
 	dbs      *nodb.Nodb
 	db       *nodb.DB
 	filepath string
+	lock     sync.Mutex // Serializes counter updates, the db is opened by this process only.
 }
 
 // Put puts value into cache with key and expire time.
@@ -96,6 +98,18 @@ func (c *NodbCacher) Decr(key string) error {
 	return err
 }
 
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *NodbCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.IsExist(key) {
+		return delta, c.Put(key, delta, expire)
+	}
+	return c.db.IncrBy([]byte(key), delta)
+}
+
 // IsExist returns true if cached value exists.
 func (c *NodbCacher) IsExist(key string) bool {
 	num, err := c.db.Exists([]byte(key))
@@ -0,0 +1,132 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"sync"
+)
+
+// Call represents an operation received by the null cacher in recording mode.
+type Call struct {
+	Op     string
+	Key    string
+	Val    interface{}
+	Expire int64
+}
+
+// NullCacher represents a cache adapter that stores nothing: every write
+// succeeds and every read misses. It can optionally record calls it receives.
+type NullCacher struct {
+	lock   sync.Mutex
+	record bool
+	calls  []Call
+}
+
+// NewNullCacher creates and returns a new null cacher,
+// it records calls it receives if record is true.
+func NewNullCacher(record bool) *NullCacher {
+	return &NullCacher{record: record}
+}
+
+func (c *NullCacher) add(call Call) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.record {
+		c.calls = append(c.calls, call)
+	}
+}
+
+// Calls returns a copy of recorded calls in the order they were received.
+func (c *NullCacher) Calls() []Call {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	calls := make([]Call, len(c.calls))
+	copy(calls, c.calls)
+	return calls
+}
+
+// Reset clears recorded calls.
+func (c *NullCacher) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls = nil
+}
+
+// Put accepts and discards value.
+func (c *NullCacher) Put(key string, val interface{}, expire int64) error {
+	c.add(Call{Op: "Put", Key: key, Val: val, Expire: expire})
+	return nil
+}
+
+// Get always returns nil.
+func (c *NullCacher) Get(key string) interface{} {
+	c.add(Call{Op: "Get", Key: key})
+	return nil
+}
+
+// Delete does nothing.
+func (c *NullCacher) Delete(key string) error {
+	c.add(Call{Op: "Delete", Key: key})
+	return nil
+}
+
+// Incr does nothing.
+func (c *NullCacher) Incr(key string) error {
+	c.add(Call{Op: "Incr", Key: key})
+	return nil
+}
+
+// Decr does nothing.
+func (c *NullCacher) Decr(key string) error {
+	c.add(Call{Op: "Decr", Key: key})
+	return nil
+}
+
+// IncrBy returns delta, as the counter never exists.
+func (c *NullCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	c.add(Call{Op: "IncrBy", Key: key, Val: delta, Expire: expire})
+	return delta, nil
+}
+
+// IsExist always returns false.
+func (c *NullCacher) IsExist(key string) bool {
+	c.add(Call{Op: "IsExist", Key: key})
+	return false
+}
+
+// Flush does nothing.
+func (c *NullCacher) Flush() error {
+	c.add(Call{Op: "Flush"})
+	return nil
+}
+
+// StartAndGC starts no GC routine, it only enables recording mode
+// if config string is "record".
+// AdapterConfig: record
+func (c *NullCacher) StartAndGC(opt Options) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.record = opt.AdapterConfig == "record"
+	c.calls = nil
+	return nil
+}
+
+func init() {
+	Register("null", NewNullCacher(false))
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_NullCacher(t *testing.T) {
+	Convey("Test null cache adapter", t, func() {
+		m := macaron.New()
+		m.Use(Cacher(Options{Adapter: "null"}))
+		m.Get("/", func(c Cache) {
+			So(c.Put("uname", "unknwon", 0), ShouldBeNil)
+			So(c.Get("uname"), ShouldBeNil)
+			So(c.IsExist("uname"), ShouldBeFalse)
+			So(c.Incr("uname"), ShouldBeNil)
+			So(c.Decr("uname"), ShouldBeNil)
+			So(c.Delete("uname"), ShouldBeNil)
+			So(c.Flush(), ShouldBeNil)
+			So(c.(*NullCacher).Calls(), ShouldBeEmpty)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+	})
+
+	Convey("Record calls", t, func() {
+		c := NewNullCacher(true)
+		So(c.Put("uname", "unknwon", 60), ShouldBeNil)
+		So(c.Get("uname"), ShouldBeNil)
+		So(c.Delete("uname"), ShouldBeNil)
+		So(c.Calls(), ShouldResemble, []Call{
+			{Op: "Put", Key: "uname", Val: "unknwon", Expire: 60},
+			{Op: "Get", Key: "uname"},
+			{Op: "Delete", Key: "uname"},
+		})
+
+		c.Reset()
+		So(c.Calls(), ShouldBeEmpty)
+
+		So(c.StartAndGC(Options{AdapterConfig: "record"}), ShouldBeNil)
+		So(c.Flush(), ShouldBeNil)
+		So(c.Calls(), ShouldResemble, []Call{{Op: "Flush"}})
+	})
+}
@@ -0,0 +1,539 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// PageOptions represents a struct for specifying configuration options for the page cache middleware.
+type PageOptions struct {
+	// Prefix of cache keys. Default is "page:".
+	KeyPrefix string
+	// Request headers whose values make different cache entries.
+	VaryHeaders []string
+	// Cookies whose values make different cache entries.
+	VaryCookies []string
+	// Clock used to compute age of cached responses. Default is DefaultClock.
+	Clock Clock
+}
+
+func preparePageOptions(options []PageOptions) PageOptions {
+	var opt PageOptions
+	if len(options) > 0 {
+		opt = options[0]
+	}
+	if len(opt.KeyPrefix) == 0 {
+		opt.KeyPrefix = "page:"
+	}
+	if opt.Clock == nil {
+		opt.Clock = DefaultClock
+	}
+	return opt
+}
+
+// pageEntry represents a cached response. An entry with a non-empty Vary
+// and no status is an index that points to variants of the response.
+type pageEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Vary   []string
+	Stored int64 // Unix time the response was stored.
+	Age    int64 // Age of the response in seconds when stored, as reported upstream.
+	MaxAge int64 // Freshness lifetime in seconds.
+	Stale  int64 // Seconds the response may be served stale while revalidating.
+}
+
+func (e *pageEntry) isIndex() bool {
+	return e.Status == 0 && len(e.Vary) > 0
+}
+
+func encodePage(e *pageEntry) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(e)
+	return buf.Bytes(), err
+}
+
+// decodePage decodes a cached response, it accepts the string form
+// stored by adapters that do not keep value types.
+func decodePage(val interface{}) (*pageEntry, bool) {
+	var data []byte
+	switch val := val.(type) {
+	case []byte:
+		data = val
+	case string:
+		data = []byte(val)
+	default:
+		return nil, false
+	}
+
+	e := new(pageEntry)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(e); err != nil {
+		return nil, false
+	}
+	return e, true
+}
+
+func hashKey(prefix string, data []byte) string {
+	m := md5.Sum(data)
+	return prefix + hex.EncodeToString(m[:])
+}
+
+// pageKey returns the cache key of the request. HEAD requests share
+// entries with GET requests because their responses differ only by the body.
+func pageKey(ctx *macaron.Context, opt PageOptions) string {
+	var buf bytes.Buffer
+	buf.WriteString("GET ")
+	buf.WriteString(ctx.Req.URL.Path)
+	buf.WriteString("?")
+	buf.WriteString(ctx.Req.URL.Query().Encode())
+	for _, name := range opt.VaryHeaders {
+		buf.WriteString("\nheader:")
+		buf.WriteString(name)
+		buf.WriteString("=")
+		buf.WriteString(strings.Join(ctx.Req.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	for _, name := range opt.VaryCookies {
+		buf.WriteString("\ncookie:")
+		buf.WriteString(name)
+		buf.WriteString("=")
+		buf.WriteString(ctx.GetCookie(name))
+	}
+	return hashKey(opt.KeyPrefix, buf.Bytes())
+}
+
+// variantKey returns the cache key of the response variant selected
+// by given request headers named in the Vary response header.
+func variantKey(key string, vary []string, header http.Header) string {
+	var buf bytes.Buffer
+	buf.WriteString(key)
+	for _, name := range vary {
+		buf.WriteString("\n")
+		buf.WriteString(name)
+		buf.WriteString("=")
+		buf.WriteString(strings.Join(header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return hashKey(key+":", buf.Bytes())
+}
+
+// cacheControl represents parsed directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, line := range header["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if len(part) == 0 {
+				continue
+			}
+			fields := strings.SplitN(part, "=", 2)
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if len(fields) > 1 {
+				cc[name] = strings.Trim(strings.TrimSpace(fields[1]), `"`)
+			} else {
+				cc[name] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns value of a delta-seconds directive, or -1 if absent or invalid.
+func (cc cacheControl) seconds(name string) int64 {
+	v, ok := cc[name]
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// freshness returns freshness lifetime of a response in seconds as a shared cache sees it,
+// in order of s-maxage, max-age and Expires, or def if none is present.
+func freshness(cc cacheControl, header http.Header, now time.Time, def int64) int64 {
+	if n := cc.seconds("s-maxage"); n >= 0 {
+		return n
+	} else if n = cc.seconds("max-age"); n >= 0 {
+		return n
+	}
+
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates, e.g. "0", mean already expired.
+			return 0
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if n := int64(t.Sub(now) / time.Second); n > 0 {
+			return n
+		}
+		return 0
+	}
+	return def
+}
+
+// etagMatch returns true if the If-None-Match header value matches given entity tag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified returns true if conditional headers of the request are satisfied by the entry.
+func notModified(req *http.Request, e *pageEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		return etagMatch(inm, e.Header.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// pageRecorder buffers the response until the handler returns,
+// so that validators can be added to its header before it is sent.
+// Once flushed, the response is streamed to the client and not stored.
+type pageRecorder struct {
+	macaron.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	flushed bool
+}
+
+func (w *pageRecorder) WriteHeader(status int) {
+	if w.flushed {
+		w.ResponseWriter.WriteHeader(status)
+	} else if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *pageRecorder) Write(p []byte) (int, error) {
+	if w.flushed {
+		return w.ResponseWriter.Write(p)
+	}
+	if !w.Written() {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+func (w *pageRecorder) Status() int {
+	if w.flushed {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *pageRecorder) Written() bool {
+	return w.Status() != 0
+}
+
+func (w *pageRecorder) Size() int {
+	if w.flushed {
+		return w.ResponseWriter.Size()
+	}
+	return w.body.Len()
+}
+
+// Flush sends the buffered response and streams the rest of it to the client.
+func (w *pageRecorder) Flush() {
+	w.send()
+	w.flushed = true
+	w.ResponseWriter.Flush()
+}
+
+// send writes the buffered response to the client.
+func (w *pageRecorder) send() {
+	if w.flushed || w.status == 0 {
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(w.body.Bytes())
+	w.body.Reset()
+}
+
+// discardWriter is the response writer of background revalidation requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+// setRenderWriter points the render middleware to given writer.
+func setRenderWriter(ctx *macaron.Context, w http.ResponseWriter) {
+	if _, ok := ctx.Render.(*macaron.DummyRender); ok {
+		ctx.Render = &macaron.DummyRender{ResponseWriter: w}
+		return
+	}
+	ctx.Render.SetResponseWriter(w)
+}
+
+// lookupPage returns the cached response of the key,
+// selecting its variant by given request headers.
+func lookupPage(c Cache, key string, header http.Header) (*pageEntry, bool) {
+	e, ok := decodePage(c.Get(key))
+	if ok && e.isIndex() {
+		e, ok = decodePage(c.Get(variantKey(key, e.Vary, header)))
+	}
+	return e, ok && !e.isIndex()
+}
+
+// pageAge returns the current age of the cached response in seconds.
+func pageAge(e *pageEntry, clock Clock) int64 {
+	age := clock.Now().Unix() - e.Stored
+	if age < 0 {
+		age = 0
+	}
+	return age + e.Age
+}
+
+// servePage writes the cached response to the client.
+func servePage(ctx *macaron.Context, e *pageEntry, age int64, status string) {
+	header := ctx.Resp.Header()
+	for k, v := range e.Header {
+		header[k] = v
+	}
+	header.Set("Age", strconv.FormatInt(age, 10))
+	header.Set("X-Cache", status)
+
+	if notModified(ctx.Req.Request, e) {
+		ctx.Resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	ctx.Resp.WriteHeader(e.Status)
+	_, _ = ctx.Resp.Write(e.Body)
+}
+
+// revalidate refreshes the cached response in background by replaying
+// the request through the router, bypassing the cached one. The response
+// is looked up again once the revalidation is claimed, as another one
+// may have refreshed it since it was found stale.
+func revalidate(ctx *macaron.Context, c Cache, clock Clock, key string, inflight *sync.Map) {
+	if _, loaded := inflight.LoadOrStore(key, true); loaded {
+		return
+	}
+
+	req := new(http.Request)
+	*req = *ctx.Req.Request
+	req = req.WithContext(context.Background())
+	req.Method = "GET"
+	req.Header = make(http.Header, len(ctx.Req.Header))
+	for k, v := range ctx.Req.Header {
+		req.Header[k] = v
+	}
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	router := ctx.Router
+	go func() {
+		defer inflight.Delete(key)
+		if e, ok := lookupPage(c, key, req.Header); ok && pageAge(e, clock) < e.MaxAge {
+			return
+		}
+		router.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+	}()
+}
+
+// Page is a middleware that caches complete responses of GET and HEAD requests
+// in the cache.Cache mapped by Cacher, acting as a shared HTTP cache.
+//
+// Freshness lifetime of a response is taken from its s-maxage or max-age
+// Cache-Control directive or Expires header, and is ttl seconds if none of them is present.
+// Responses marked no-store, no-cache or private, setting cookies, or answering
+// requests with Authorization header unless marked public, are not stored.
+// Stale responses are served during their stale-while-revalidate period while being
+// refreshed in background. Requests marked no-store bypass the cache, and requests
+// marked no-cache or with a max-age exceeded by the response age are served fresh.
+//
+// Responses are served with Age header and the X-Cache header set to HIT, STALE or MISS,
+// conditional requests with matching If-None-Match or If-Modified-Since are answered with 304.
+// Missed responses are buffered until the handler returns, stored ones are sent with the same
+// ETag and Last-Modified validators as later hits. Responses flushed by the handler are
+// streamed to the client instead, and are not stored. The Age of a response given by upstream
+// counts towards its freshness.
+// An single variadic cache.PageOptions struct can be optionally provided to configure.
+func Page(ttl int64, options ...PageOptions) macaron.Handler {
+	opt := preparePageOptions(options)
+	inflight := new(sync.Map)
+	return func(ctx *macaron.Context, c Cache) {
+		if ctx.Req.Method != "GET" && ctx.Req.Method != "HEAD" {
+			return
+		}
+
+		reqCC := parseCacheControl(ctx.Req.Header)
+		if reqCC.has("no-store") {
+			return
+		}
+
+		key := pageKey(ctx, opt)
+		if !reqCC.has("no-cache") && ctx.Req.Header.Get("Pragma") != "no-cache" {
+			if e, ok := lookupPage(c, key, ctx.Req.Header); ok {
+				age := pageAge(e, opt.Clock)
+				maxAge := reqCC.seconds("max-age")
+				if maxAge < 0 || age <= maxAge {
+					if age < e.MaxAge {
+						servePage(ctx, e, age, "HIT")
+						return
+					} else if age < e.MaxAge+e.Stale {
+						servePage(ctx, e, age, "STALE")
+						revalidate(ctx, c, opt.Clock, key, inflight)
+						return
+					}
+				}
+			}
+		}
+
+		ctx.Resp.Header().Set("X-Cache", "MISS")
+		resp := ctx.Resp
+		w := &pageRecorder{ResponseWriter: resp}
+		ctx.Resp = w
+		ctx.MapTo(w, (*http.ResponseWriter)(nil))
+		setRenderWriter(ctx, w)
+		defer func() {
+			ctx.Resp = resp
+			ctx.MapTo(resp, (*http.ResponseWriter)(nil))
+			setRenderWriter(ctx, resp)
+		}()
+
+		ctx.Next()
+		defer w.send()
+
+		// Responses to HEAD requests have no body, responses setting
+		// cookies are specific to the client, and streamed ones are
+		// already sent.
+		if ctx.Req.Method != "GET" || w.flushed ||
+			w.Status() != http.StatusOK ||
+			len(w.Header().Get("Set-Cookie")) > 0 {
+			return
+		}
+
+		respCC := parseCacheControl(w.Header())
+		if respCC.has("no-store") || respCC.has("no-cache") || respCC.has("private") {
+			return
+		} else if len(ctx.Req.Header.Get("Authorization")) > 0 &&
+			!respCC.has("public") && !respCC.has("s-maxage") {
+			return
+		}
+
+		now := opt.Clock.Now()
+		e := &pageEntry{
+			Status: w.Status(),
+			Header: make(http.Header),
+			Body:   w.body.Bytes(),
+			Stored: now.Unix(),
+			MaxAge: freshness(respCC, w.Header(), now, ttl),
+		}
+		if n := respCC.seconds("stale-while-revalidate"); n > 0 {
+			e.Stale = n
+		}
+		if n, err := strconv.ParseInt(w.Header().Get("Age"), 10, 64); err == nil && n > 0 {
+			e.Age = n
+		}
+		if e.MaxAge+e.Stale <= e.Age {
+			return
+		}
+
+		for _, line := range w.Header()["Vary"] {
+			for _, name := range strings.Split(line, ",") {
+				name = strings.TrimSpace(name)
+				if name == "*" {
+					return
+				} else if len(name) > 0 {
+					e.Vary = append(e.Vary, name)
+				}
+			}
+		}
+
+		// Validators are sent with the response as well, so that clients
+		// can revalidate it against the stored one.
+		if len(w.Header().Get("ETag")) == 0 {
+			m := md5.Sum(e.Body)
+			w.Header().Set("ETag", `"`+hex.EncodeToString(m[:])+`"`)
+		}
+		if len(w.Header().Get("Last-Modified")) == 0 {
+			w.Header().Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+		}
+		for k, v := range w.Header() {
+			switch k {
+			case "X-Cache", "Age", "Content-Length":
+				continue
+			}
+			e.Header[k] = v
+		}
+
+		expire := e.MaxAge + e.Stale - e.Age
+		if len(e.Vary) > 0 {
+			index, err := encodePage(&pageEntry{Vary: e.Vary})
+			if err != nil {
+				return
+			}
+			if err = c.Put(key, index, expire); err != nil {
+				return
+			}
+			key = variantKey(key, e.Vary, ctx.Req.Header)
+		}
+
+		data, err := encodePage(e)
+		if err != nil {
+			return
+		}
+		_ = c.Put(key, data, expire)
+	}
+}
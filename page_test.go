@@ -0,0 +1,307 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Page(t *testing.T) {
+	Convey("Cache complete responses", t, func() {
+		m := macaron.New()
+		m.Use(Cacher(Options{Adapter: "memory", Interval: 60}))
+		So(adapters["memory"].Flush(), ShouldBeNil)
+		m.Use(Page(60, PageOptions{
+			VaryHeaders: []string{"Accept-Language"},
+			VaryCookies: []string{"lang"},
+		}))
+
+		calls := 0
+		m.Get("/", func(ctx *macaron.Context) {
+			calls++
+			ctx.Resp.Header().Set("X-Calls", strconv.Itoa(calls))
+			_, _ = ctx.Write([]byte("hello " + ctx.Query("name")))
+		})
+		m.Get("/cookie", func(ctx *macaron.Context) {
+			calls++
+			ctx.SetCookie("session", "1")
+			_, _ = ctx.Write([]byte("cookie"))
+		})
+		m.Post("/", func(ctx *macaron.Context) {
+			calls++
+		})
+
+		serve := func(method, url string, header http.Header) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(method, url, nil)
+			So(err, ShouldBeNil)
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			m.ServeHTTP(resp, req)
+			return resp
+		}
+
+		resp := serve("GET", "/?name=macaron", nil)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("X-Cache"), ShouldEqual, "MISS")
+		So(resp.Body.String(), ShouldEqual, "hello macaron")
+		missETag := resp.Header().Get("ETag")
+		missLastModified := resp.Header().Get("Last-Modified")
+		So(missETag, ShouldNotBeEmpty)
+		So(missLastModified, ShouldNotBeEmpty)
+
+		resp = serve("GET", "/?name=macaron", nil)
+		So(resp.Header().Get("X-Cache"), ShouldEqual, "HIT")
+		So(resp.Header().Get("X-Calls"), ShouldEqual, "1")
+		So(resp.Body.String(), ShouldEqual, "hello macaron")
+		etag := resp.Header().Get("ETag")
+		So(etag, ShouldEqual, missETag)
+		So(resp.Header().Get("Last-Modified"), ShouldEqual, missLastModified)
+
+		resp = serve("HEAD", "/?name=macaron", nil)
+		So(resp.Header().Get("X-Cache"), ShouldEqual, "HIT")
+		So(resp.Body.Len(), ShouldEqual, 0)
+
+		Convey("Answer If-None-Match with 304", func() {
+			resp := serve("GET", "/?name=macaron", http.Header{"If-None-Match": {`"other", ` + etag}})
+			So(resp.Code, ShouldEqual, http.StatusNotModified)
+			So(resp.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Vary on query, headers and cookies", func() {
+			So(serve("GET", "/?name=unknwon", nil).Header().Get("X-Cache"), ShouldEqual, "MISS")
+			So(serve("GET", "/?name=macaron", http.Header{"Accept-Language": {"zh-CN"}}).Header().Get("X-Cache"), ShouldEqual, "MISS")
+			So(serve("GET", "/?name=macaron", http.Header{"Cookie": {"lang=zh-CN"}}).Header().Get("X-Cache"), ShouldEqual, "MISS")
+			So(serve("GET", "/?name=macaron", http.Header{"Cookie": {"other=1"}}).Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(calls, ShouldEqual, 4)
+		})
+
+		Convey("Skip other methods and responses setting cookies", func() {
+			So(serve("POST", "/", nil).Header().Get("X-Cache"), ShouldBeEmpty)
+			So(serve("GET", "/cookie", nil).Header().Get("X-Cache"), ShouldEqual, "MISS")
+			So(serve("GET", "/cookie", nil).Header().Get("X-Cache"), ShouldEqual, "MISS")
+			So(calls, ShouldEqual, 4)
+		})
+	})
+}
+
+// storeNotifier signals responses stored by the page cache middleware.
+type storeNotifier struct {
+	Cache
+	stored chan string
+}
+
+func (c storeNotifier) Put(key string, val interface{}, expire int64) error {
+	err := c.Cache.Put(key, val, expire)
+	select {
+	case c.stored <- key:
+	default:
+	}
+	return err
+}
+
+func Test_Page_CacheControl(t *testing.T) {
+	Convey("Honor Cache-Control", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		m := macaron.New()
+		m.Use(Cacher(Options{Adapter: "memory", Interval: 60, Clock: clock}))
+		So(adapters["memory"].Flush(), ShouldBeNil)
+		stored := make(chan string, 1)
+		m.Use(func(ctx *macaron.Context, c Cache) {
+			ctx.MapTo(storeNotifier{c, stored}, (*Cache)(nil))
+		})
+		m.Use(Page(60, PageOptions{Clock: clock}))
+
+		calls := 0
+		route := func(pattern, cacheControl string, header ...string) {
+			m.Get(pattern, func(ctx *macaron.Context) {
+				calls++
+				if len(cacheControl) > 0 {
+					ctx.Resp.Header().Set("Cache-Control", cacheControl)
+				}
+				for i := 0; i+1 < len(header); i += 2 {
+					ctx.Resp.Header().Set(header[i], header[i+1])
+				}
+				_, _ = ctx.Write([]byte(strconv.Itoa(calls)))
+			})
+		}
+		route("/default", "")
+		route("/max-age", "public, max-age=10")
+		route("/s-maxage", "max-age=100, s-maxage=5")
+		route("/no-store", "no-store")
+		route("/private", "private, max-age=10")
+		route("/expires", "", "Expires", time.Unix(1e9+20, 0).UTC().Format(http.TimeFormat))
+		route("/vary", "max-age=10", "Vary", "Accept-Language")
+		route("/aged", "max-age=10", "Age", "4")
+
+		serve := func(url string, header ...string) *httptest.ResponseRecorder {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", url, nil)
+			So(err, ShouldBeNil)
+			for i := 0; i+1 < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			m.ServeHTTP(resp, req)
+			return resp
+		}
+		xcache := func(url string, header ...string) string {
+			return serve(url, header...).Header().Get("X-Cache")
+		}
+
+		Convey("Use response freshness lifetime", func() {
+			So(xcache("/max-age"), ShouldEqual, "MISS")
+			clock.Advance(9 * time.Second)
+			resp := serve("/max-age")
+			So(resp.Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(resp.Header().Get("Age"), ShouldEqual, "9")
+			clock.Advance(time.Second)
+			So(xcache("/max-age"), ShouldEqual, "MISS")
+
+			So(xcache("/s-maxage"), ShouldEqual, "MISS")
+			clock.Advance(5 * time.Second)
+			So(xcache("/s-maxage"), ShouldEqual, "MISS")
+
+			// Expires is 5 seconds from now.
+			So(xcache("/expires"), ShouldEqual, "MISS")
+			clock.Advance(4 * time.Second)
+			So(xcache("/expires"), ShouldEqual, "HIT")
+			clock.Advance(time.Second)
+			So(xcache("/expires"), ShouldEqual, "MISS")
+
+			So(xcache("/default"), ShouldEqual, "MISS")
+			clock.Advance(59 * time.Second)
+			So(xcache("/default"), ShouldEqual, "HIT")
+		})
+
+		Convey("Count upstream age", func() {
+			So(xcache("/aged"), ShouldEqual, "MISS")
+			clock.Advance(5 * time.Second)
+			resp := serve("/aged")
+			So(resp.Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(resp.Header().Get("Age"), ShouldEqual, "9")
+			clock.Advance(time.Second)
+			So(xcache("/aged"), ShouldEqual, "MISS")
+		})
+
+		Convey("Do not store uncacheable responses", func() {
+			So(xcache("/no-store"), ShouldEqual, "MISS")
+			So(xcache("/no-store"), ShouldEqual, "MISS")
+			So(xcache("/private"), ShouldEqual, "MISS")
+			So(xcache("/private"), ShouldEqual, "MISS")
+			So(xcache("/default", "Authorization", "Basic Zm9vOmJhcg=="), ShouldEqual, "MISS")
+			So(xcache("/default"), ShouldEqual, "MISS")
+			So(xcache("/max-age", "Authorization", "Basic Zm9vOmJhcg=="), ShouldEqual, "MISS")
+			So(xcache("/max-age"), ShouldEqual, "HIT")
+		})
+
+		Convey("Honor request directives", func() {
+			So(xcache("/max-age"), ShouldEqual, "MISS")
+			So(xcache("/max-age", "Cache-Control", "no-store"), ShouldBeEmpty)
+			So(xcache("/max-age", "Cache-Control", "no-cache"), ShouldEqual, "MISS")
+			clock.Advance(5 * time.Second)
+			So(xcache("/max-age", "Cache-Control", "max-age=3"), ShouldEqual, "MISS")
+			So(xcache("/max-age", "Cache-Control", "max-age=3"), ShouldEqual, "HIT")
+		})
+
+		Convey("Validate with Last-Modified", func() {
+			So(xcache("/max-age"), ShouldEqual, "MISS")
+			lastModified := serve("/max-age").Header().Get("Last-Modified")
+			So(lastModified, ShouldNotBeEmpty)
+			So(serve("/max-age", "If-Modified-Since", lastModified).Code, ShouldEqual, http.StatusNotModified)
+			So(serve("/max-age", "If-Modified-Since", time.Unix(1e9-1, 0).UTC().Format(http.TimeFormat)).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Store variants by Vary", func() {
+			So(serve("/vary", "Accept-Language", "en").Body.String(), ShouldEqual, "1")
+			So(serve("/vary", "Accept-Language", "zh").Body.String(), ShouldEqual, "2")
+			So(serve("/vary", "Accept-Language", "en").Body.String(), ShouldEqual, "1")
+			So(serve("/vary", "Accept-Language", "zh").Body.String(), ShouldEqual, "2")
+		})
+
+		Convey("Serve stale while revalidating", func() {
+			swr := 0
+			revalidating, release := make(chan int, 2), make(chan struct{})
+			m.Get("/swr", func(ctx *macaron.Context) {
+				swr++
+				if ctx.Req.Header.Get("Cache-Control") == "no-cache" {
+					revalidating <- swr
+					<-release
+				}
+				ctx.Resp.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+				_, _ = ctx.Write([]byte(strconv.Itoa(swr)))
+			})
+
+			So(serve("/swr").Body.String(), ShouldEqual, "1")
+			<-stored
+			clock.Advance(15 * time.Second)
+			resp := serve("/swr")
+			So(resp.Header().Get("X-Cache"), ShouldEqual, "STALE")
+			So(resp.Body.String(), ShouldEqual, "1")
+			So(<-revalidating, ShouldEqual, 2)
+
+			// Requests during revalidation do not start another one.
+			So(xcache("/swr"), ShouldEqual, "STALE")
+			close(release)
+			<-stored
+			So(xcache("/swr"), ShouldEqual, "HIT")
+			So(len(revalidating), ShouldEqual, 0)
+
+			resp = serve("/swr")
+			So(resp.Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(resp.Body.String(), ShouldEqual, "2")
+
+			clock.Advance(41 * time.Second)
+			So(xcache("/swr"), ShouldEqual, "MISS")
+		})
+
+		Convey("Stream flushed responses without storing them", func() {
+			m.Get("/stream", func(ctx *macaron.Context) {
+				calls++
+				_, _ = ctx.Write([]byte("1"))
+				ctx.Resp.Flush()
+				_, _ = ctx.Write([]byte("2"))
+			})
+			resp := serve("/stream")
+			So(resp.Flushed, ShouldBeTrue)
+			So(resp.Body.String(), ShouldEqual, "12")
+			So(xcache("/stream"), ShouldEqual, "MISS")
+			So(calls, ShouldEqual, 2)
+		})
+
+		Convey("Restore the response writer on panic", func() {
+			m := macaron.New()
+			m.Use(macaron.Recovery())
+			m.Use(Cacher(Options{Adapter: "memory", Interval: 60, Clock: clock}))
+			m.Use(Page(60, PageOptions{Clock: clock}))
+			m.Get("/panic", func() {
+				panic("page")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/panic", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, http.StatusInternalServerError)
+		})
+	})
+}
@@ -15,13 +15,17 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/md5"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/go-macaron/cache"
 )
@@ -30,11 +34,12 @@ import (
 type PostgresCacher struct {
 	c        *sql.DB
 	interval int
+	clock    cache.Clock
 }
 
 // NewPostgresCacher creates and returns a new postgres cacher.
 func NewPostgresCacher() *PostgresCacher {
-	return &PostgresCacher{}
+	return &PostgresCacher{clock: cache.DefaultClock}
 }
 
 func (c *PostgresCacher) md5(key string) string {
@@ -42,16 +47,24 @@ func (c *PostgresCacher) md5(key string) string {
 	return hex.EncodeToString(m[:])
 }
 
+// fencePrefix starts the row keys of fencing tokens in place of the first characters of
+// their hashes, it is not hex so the rows can be told apart and kept by Flush.
+const fencePrefix = "fence:"
+
+func (c *PostgresCacher) fenceID(key string) string {
+	return fencePrefix + c.md5(key)[len(fencePrefix):]
+}
+
 // Put puts value into cache with key and expire time.
 // If expired is 0, it will be deleted by next GC operation.
 func (c *PostgresCacher) Put(key string, val interface{}, expire int64) error {
-	item := &cache.Item{Val: val}
+	item := &cache.Item{Val: val, Key: key}
 	data, err := cache.EncodeGob(item)
 	if err != nil {
 		return err
 	}
 
-	now := time.Now().Unix()
+	now := c.clock.Now().Unix()
 	if c.IsExist(key) {
 		_, err = c.c.Exec("UPDATE cache SET data=$1, created=$2, expire=$3 WHERE key=$4", data, now, expire, c.md5(key))
 	} else {
@@ -72,7 +85,10 @@ func (c *PostgresCacher) read(key string) (*cache.Item, error) {
 	}
 
 	item := new(cache.Item)
-	if err = cache.DecodeGob(data, item); err != nil {
+	if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		// Counters created by IncrBy are stored as decimal.
+		item.Val = n
+	} else if err = cache.DecodeGob(data, item); err != nil {
 		return nil, err
 	}
 	item.Created = created
@@ -88,7 +104,7 @@ func (c *PostgresCacher) Get(key string) interface{} {
 	}
 
 	if item.Expire > 0 &&
-		(time.Now().Unix()-item.Created) >= item.Expire {
+		(c.clock.Now().Unix()-item.Created) >= item.Expire {
 		_ = c.Delete(key)
 		return nil
 	}
@@ -101,34 +117,207 @@ func (c *PostgresCacher) Delete(key string) error {
 	return err
 }
 
+// incrBy adds delta to cached int-type value by given key within a transaction.
+// A missing or expired key is created if create is true.
+func (c *PostgresCacher) incrBy(key string, delta, expire int64, create bool) (n int64, err error) {
+	tx, err := c.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if n, err = c.incrByTx(tx, c.md5(key), key, delta, expire, create); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// incrByUpsert creates, resets or adds to a decimal counter in one statement,
+// leaving other values as they are, and returns the row.
+const incrByUpsert = `INSERT INTO cache(key,data,created,expire) VALUES($1,$2,$3,$4)
+ON CONFLICT (key) DO UPDATE SET
+data=CASE WHEN cache.expire>0 AND $3-cache.created>=cache.expire THEN EXCLUDED.data
+	WHEN encode(cache.data,'escape') ~ '^-?[0-9]+$'
+	THEN convert_to((encode(cache.data,'escape')::bigint+$5)::text,'UTF8')
+	ELSE cache.data END,
+created=CASE WHEN cache.expire>0 AND $3-cache.created>=cache.expire THEN EXCLUDED.created ELSE cache.created END,
+expire=CASE WHEN cache.expire>0 AND $3-cache.created>=cache.expire THEN EXCLUDED.expire ELSE cache.expire END
+RETURNING data,created,expire`
+
+// incrByTx is incrBy of the row with given id within given transaction.
+func (c *PostgresCacher) incrByTx(tx *sql.Tx, id, key string, delta, expire int64, create bool) (int64, error) {
+	var (
+		data    []byte
+		created int64
+		exp     int64
+		err     error
+	)
+	now := c.clock.Now().Unix()
+	if create {
+		err = tx.QueryRow(incrByUpsert, id, []byte(strconv.FormatInt(delta, 10)), now, expire, delta).Scan(&data, &created, &exp)
+	} else {
+		err = tx.QueryRow("SELECT data,created,expire FROM cache WHERE key=$1 FOR UPDATE", id).Scan(&data, &created, &exp)
+	}
+	if err == sql.ErrNoRows || (err == nil && exp > 0 && now-created >= exp) {
+		return 0, fmt.Errorf("key '%s' not exist", key)
+	} else if err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		if create {
+			return n, nil
+		}
+		n += delta
+		_, err = tx.Exec("UPDATE cache SET data=$1 WHERE key=$2", []byte(strconv.FormatInt(n, 10)), id)
+		return n, err
+	}
+
+	// Values put by Put are added to with their types kept.
+	item := new(cache.Item)
+	if err = cache.DecodeGob(data, item); err != nil {
+		return 0, err
+	}
+	if item.Val, err = cache.IncrBy(item.Val, delta); err != nil {
+		return 0, err
+	}
+	if data, err = cache.EncodeGob(item); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec("UPDATE cache SET data=$1 WHERE key=$2", data, id); err != nil {
+		return 0, err
+	}
+	return cache.ToInt64(item.Val)
+}
+
 // Incr increases cached int-type value by given key as a counter.
 func (c *PostgresCacher) Incr(key string) error {
-	item, err := c.read(key)
+	_, err := c.incrBy(key, 1, 0, false)
+	return err
+}
+
+// Decrease cached int value.
+func (c *PostgresCacher) Decr(key string) error {
+	_, err := c.incrBy(key, -1, 0, false)
+	return err
+}
+
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *PostgresCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	return c.incrBy(key, delta, expire, true)
+}
+
+// seconds returns given duration in whole seconds, rounded up to at least 1.
+func seconds(d time.Duration) int64 {
+	n := int64((d + time.Second - 1) / time.Second)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Lock acquires the lock of given key that expires after ttl rounded up to seconds,
+// it returns cache.ErrLockHeld if the lock is held by another owner.
+func (c *PostgresCacher) Lock(key string, ttl time.Duration) (_ cache.Lock, err error) {
+	owner, err := cache.NewLockOwner()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	data, err := cache.EncodeGob(&cache.Item{Val: owner, Key: cache.LockPrefix + key})
+	if err != nil {
+		return nil, err
 	}
 
-	item.Val, err = cache.Incr(item.Val)
+	tx, err := c.c.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
 
-	return c.Put(key, item.Val, item.Expire)
+	key = cache.LockPrefix + key
+	var created, expire int64
+	now := c.clock.Now().Unix()
+	err = tx.QueryRow("SELECT created,expire FROM cache WHERE key=$1 FOR UPDATE", c.md5(key)).Scan(&created, &expire)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO cache(key,data,created,expire) VALUES($1,$2,$3,$4)", c.md5(key), data, now, seconds(ttl))
+		// unique_violation
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+			err = cache.ErrLockHeld
+		}
+	case err != nil:
+	case now-created < expire:
+		err = cache.ErrLockHeld
+	default:
+		_, err = tx.Exec("UPDATE cache SET data=$1, created=$2, expire=$3 WHERE key=$4", data, now, seconds(ttl), c.md5(key))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := c.incrByTx(tx, c.fenceID(key+cache.FenceSuffix), key+cache.FenceSuffix, 1, cache.FenceExpire, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return cache.NewLock(token, func() error {
+		return c.unlock(key, data)
+	}, func(ttl time.Duration) error {
+		return c.refreshLock(key, data, ttl)
+	}), nil
 }
 
-// Decrease cached int value.
-func (c *PostgresCacher) Decr(key string) error {
-	item, err := c.read(key)
+// unlock deletes the lock only if it is still held by the owner.
+func (c *PostgresCacher) unlock(key string, data []byte) error {
+	res, err := c.c.Exec("DELETE FROM cache WHERE key=$1 AND data=$2 AND $3 - created < expire", c.md5(key), data, c.clock.Now().Unix())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
 		return err
+	} else if n == 0 {
+		return cache.ErrLockLost
 	}
+	return nil
+}
 
-	item.Val, err = cache.Decr(item.Val)
+// refreshLock extends the lock only if it is still held by the owner.
+func (c *PostgresCacher) refreshLock(key string, data []byte, ttl time.Duration) (err error) {
+	tx, err := c.c.Begin()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
 
-	return c.Put(key, item.Val, item.Expire)
+	var (
+		owner   []byte
+		created int64
+		expire  int64
+	)
+	now := c.clock.Now().Unix()
+	err = tx.QueryRow("SELECT data,created,expire FROM cache WHERE key=$1 FOR UPDATE", c.md5(key)).Scan(&owner, &created, &expire)
+	if err == sql.ErrNoRows || (err == nil && (!bytes.Equal(owner, data) || now-created >= expire)) {
+		err = cache.ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE cache SET created=$1, expire=$2 WHERE key=$3", now, seconds(ttl), c.md5(key)); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // IsExist returns true if cached value exists.
@@ -141,27 +330,114 @@ func (c *PostgresCacher) IsExist(key string) bool {
 	return err != sql.ErrNoRows
 }
 
-// Flush deletes all cached data.
+// Inspect describes cached value by given key, it returns false if the value does not exist.
+func (c *PostgresCacher) Inspect(key string) (cache.Entry, bool) {
+	var (
+		data    []byte
+		created int64
+		expire  int64
+	)
+	err := c.c.QueryRow("SELECT data,created,expire FROM cache WHERE key=$1", c.md5(key)).Scan(&data, &created, &expire)
+	if err != nil || (expire > 0 && c.clock.Now().Unix()-created >= expire) {
+		return cache.Entry{}, false
+	}
+	return cache.NewEntry(key, int64(len(data)), created, expire), true
+}
+
+// Scan calls fn with every cached value in no particular order until fn returns false.
+// Counters created by IncrBy are skipped, as only hashes of their keys are stored.
+func (c *PostgresCacher) Scan(fn func(cache.Entry) bool) error {
+	rows, err := c.c.Query("SELECT data,created,expire FROM cache")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	now := c.clock.Now().Unix()
+	for rows.Next() {
+		var (
+			data    []byte
+			created int64
+			expire  int64
+		)
+		if err = rows.Scan(&data, &created, &expire); err != nil {
+			return err
+		} else if expire > 0 && now-created >= expire {
+			continue
+		}
+
+		item := new(cache.Item)
+		if cache.DecodeGob(data, item) != nil || len(item.Key) == 0 {
+			continue
+		}
+		if !fn(cache.NewEntry(item.Key, int64(len(data)), created, expire)) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// Stats returns number of rows in the cache table.
+func (c *PostgresCacher) Stats() map[string]int64 {
+	var n int64
+	if err := c.c.QueryRow("SELECT COUNT(*) FROM cache").Scan(&n); err != nil {
+		log.Printf("cache/postgres: error counting rows: %v", err)
+	}
+	return map[string]int64{"rows": n}
+}
+
+// Flush deletes all cached data, fencing tokens of locks are kept
+// so that they keep increasing.
 func (c *PostgresCacher) Flush() error {
-	_, err := c.c.Exec("DELETE FROM cache")
+	_, err := c.c.Exec("DELETE FROM cache WHERE key NOT LIKE '" + fencePrefix + "%'")
 	return err
 }
 
+// Ping returns an error if the database cannot be reached.
+func (c *PostgresCacher) Ping() error {
+	return c.c.Ping()
+}
+
+// IsRetryable returns true if the operation failed with given error may succeed on retry.
+func (c *PostgresCacher) IsRetryable(err error) bool {
+	switch err := err.(type) {
+	case *pq.Error:
+		// serialization_failure and deadlock_detected
+		return err.Code == "40001" || err.Code == "40P01"
+	}
+	return err == driver.ErrBadConn || cache.IsTransientError(err)
+}
+
+// IsUnapplied returns true if the operation failed with given error had no effect,
+// as the connection was not used or the transaction was rolled back.
+func (c *PostgresCacher) IsUnapplied(err error) bool {
+	if err, ok := err.(*pq.Error); ok {
+		// serialization_failure and deadlock_detected
+		return err.Code == "40001" || err.Code == "40P01"
+	}
+	return err == driver.ErrBadConn
+}
+
 func (c *PostgresCacher) startGC() {
 	if c.interval < 1 {
 		return
 	}
 
-	if _, err := c.c.Exec("DELETE FROM cache WHERE EXTRACT(EPOCH FROM NOW()) - created >= expire"); err != nil {
+	if _, err := c.c.Exec("DELETE FROM cache WHERE $1 - created >= expire", c.clock.Now().Unix()); err != nil {
 		log.Printf("cache/postgres: error garbage collecting: %v", err)
 	}
 
-	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
+	c.clock.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC() })
 }
 
 // StartAndGC starts GC routine based on config string settings.
 func (c *PostgresCacher) StartAndGC(opt cache.Options) (err error) {
 	c.interval = opt.Interval
+	if opt.Clock != nil {
+		c.clock = opt.Clock
+	} else if c.clock == nil {
+		c.clock = cache.DefaultClock
+	}
 
 	c.c, err = sql.Open("postgres", opt.AdapterConfig)
 	if err != nil {
@@ -170,7 +446,7 @@ func (c *PostgresCacher) StartAndGC(opt cache.Options) (err error) {
 		return err
 	}
 
-	go c.startGC()
+	c.clock.AfterFunc(0, func() { c.startGC() })
 	return nil
 }
 
@@ -122,5 +122,39 @@ func Test_PostgresCacher(t *testing.T) {
 			So(err, ShouldBeNil)
 			m.ServeHTTP(resp, req)
 		})
+
+		Convey("Lock operations", func() {
+			m := macaron.New()
+			m.Use(cache.Cacher(opt))
+
+			m.Get("/", func(c cache.Cache) {
+				l, err := cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldBeNil)
+				_, err = cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldEqual, cache.ErrLockHeld)
+
+				So(l.Refresh(3*time.Second), ShouldBeNil)
+				So(l.Unlock(), ShouldBeNil)
+				So(l.Unlock(), ShouldEqual, cache.ErrLockLost)
+
+				l2, err := cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldBeNil)
+				So(l2.Token(), ShouldBeGreaterThan, l.Token())
+				So(l.Refresh(time.Second), ShouldEqual, cache.ErrLockLost)
+				So(l2.Unlock(), ShouldBeNil)
+
+				// Fencing tokens are kept by Flush.
+				So(c.Flush(), ShouldBeNil)
+				l3, err := cache.AcquireLock(c, "job", 2*time.Second, 0)
+				So(err, ShouldBeNil)
+				So(l3.Token(), ShouldBeGreaterThan, l2.Token())
+				So(l3.Unlock(), ShouldBeNil)
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(resp, req)
+		})
 	})
 }
@@ -0,0 +1,340 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// RateLimitAlgorithm represents an algorithm of rate limiting.
+type RateLimitAlgorithm int
+
+const (
+	// FixedWindow counts requests in consecutive windows of fixed length.
+	// It is atomic across processes for adapters implementing Counter.
+	FixedWindow RateLimitAlgorithm = iota
+	// SlidingWindowLog keeps the time of every request in the last period.
+	SlidingWindowLog
+	// TokenBucket refills a bucket of requests at a steady rate and allows bursts.
+	TokenBucket
+)
+
+// RateLimitOptions represents a struct for specifying configuration options for the rate limit middleware.
+type RateLimitOptions struct {
+	// Algorithm of rate limiting. Default is FixedWindow.
+	Algorithm RateLimitAlgorithm
+	// Maximum number of requests per period. Default is 60.
+	Limit int64
+	// Length of the period. Default is 1 minute.
+	Period time.Duration
+	// Maximum number of requests allowed at once by TokenBucket. Default is Limit.
+	Burst int64
+	// KeyFunc returns the identity requests are limited by. Default is KeyByIP,
+	// or KeyByProxiedIP of TrustedProxies if any is given.
+	KeyFunc func(*macaron.Context) string
+	// Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For
+	// and X-Real-IP headers are trusted by the default KeyFunc.
+	TrustedProxies []string
+	// Prefix of cache keys. Default is "ratelimit:".
+	KeyPrefix string
+	// Clock used to measure time. Default is DefaultClock.
+	Clock Clock
+}
+
+func prepareRateLimitOptions(options []RateLimitOptions) RateLimitOptions {
+	var opt RateLimitOptions
+	if len(options) > 0 {
+		opt = options[0]
+	}
+	if opt.Limit < 1 {
+		opt.Limit = 60
+	}
+	if opt.Period <= 0 {
+		opt.Period = time.Minute
+	}
+	if opt.Burst < 1 {
+		opt.Burst = opt.Limit
+	}
+	if opt.KeyFunc == nil {
+		if len(opt.TrustedProxies) > 0 {
+			opt.KeyFunc = KeyByProxiedIP(opt.TrustedProxies...)
+		} else {
+			opt.KeyFunc = KeyByIP
+		}
+	}
+	if len(opt.KeyPrefix) == 0 {
+		opt.KeyPrefix = "ratelimit:"
+	}
+	if opt.Clock == nil {
+		opt.Clock = DefaultClock
+	}
+	return opt
+}
+
+// remoteHost returns the host part of the address of the connection peer.
+func remoteHost(ctx *macaron.Context) string {
+	host, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		return ctx.Req.RemoteAddr
+	}
+	return host
+}
+
+// KeyByIP limits requests by IP address of the connection peer,
+// proxy headers are ignored since any client can set them.
+func KeyByIP(ctx *macaron.Context) string {
+	return remoteHost(ctx)
+}
+
+// parseProxies parses addresses and CIDR ranges of trusted proxies.
+func parseProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Printf("cache: invalid trusted proxy '%s': %v", proxy, err)
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// KeyByProxiedIP limits requests by client IP address. The X-Forwarded-For and
+// X-Real-IP headers are honored only on requests coming from one of given trusted
+// proxies, which are addresses or CIDR ranges. Proxies in X-Forwarded-For are
+// skipped from the right until the first untrusted address, which is the client.
+func KeyByProxiedIP(proxies ...string) func(*macaron.Context) string {
+	nets := parseProxies(proxies)
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(ctx *macaron.Context) string {
+		addr := remoteHost(ctx)
+		if !trusted(addr) {
+			return addr
+		}
+
+		if forwarded := ctx.Req.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded, ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				addr = strings.TrimSpace(hops[i])
+				if !trusted(addr) {
+					break
+				}
+			}
+			return addr
+		} else if ip := ctx.Req.Header.Get("X-Real-IP"); len(ip) > 0 {
+			return ip
+		}
+		return addr
+	}
+}
+
+// KeyByRoute limits requests by method and path.
+func KeyByRoute(ctx *macaron.Context) string {
+	return ctx.Req.Method + " " + ctx.Req.URL.Path
+}
+
+// KeyByHeader limits requests by value of given request header, e.g. an API token.
+func KeyByHeader(name string) func(*macaron.Context) string {
+	return func(ctx *macaron.Context) string {
+		return ctx.Req.Header.Get(name)
+	}
+}
+
+// rateLimitResult represents the decision on a request.
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int64
+	reset      time.Time
+	retryAfter time.Duration
+}
+
+// seconds returns given duration in whole seconds, rounded up to at least 1.
+func seconds(d time.Duration) int64 {
+	n := int64((d + time.Second - 1) / time.Second)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func toString(val interface{}) (string, bool) {
+	switch val := val.(type) {
+	case string:
+		return val, true
+	case []byte:
+		return string(val), true
+	}
+	return "", false
+}
+
+var rateLimitLocks keyLocks
+
+func fixedWindow(c Cache, key string, now time.Time, opt RateLimitOptions) (*rateLimitResult, error) {
+	window := now.UnixNano() / int64(opt.Period)
+	reset := time.Unix(0, (window+1)*int64(opt.Period))
+	count, err := Increment(c, key+":"+strconv.FormatInt(window, 10), 1, seconds(reset.Sub(now)))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rateLimitResult{
+		allowed:   count <= opt.Limit,
+		remaining: opt.Limit - count,
+		reset:     reset,
+	}
+	if !res.allowed {
+		res.remaining = 0
+		res.retryAfter = reset.Sub(now)
+	}
+	return res, nil
+}
+
+// slidingWindowLog stores request times in the cache as comma-separated Unix nanoseconds.
+// Updates are atomic only within the process.
+func slidingWindowLog(c Cache, key string, now time.Time, opt RateLimitOptions) (*rateLimitResult, error) {
+	lock := rateLimitLocks.get(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	start := now.Add(-opt.Period).UnixNano()
+	var times []int64
+	if val, ok := toString(c.Get(key)); ok && len(val) > 0 {
+		for _, field := range strings.Split(val, ",") {
+			t, err := strconv.ParseInt(field, 10, 64)
+			if err == nil && t > start {
+				times = append(times, t)
+			}
+		}
+	}
+
+	res := &rateLimitResult{allowed: int64(len(times)) < opt.Limit}
+	if res.allowed {
+		times = append(times, now.UnixNano())
+	}
+	res.remaining = opt.Limit - int64(len(times))
+	res.reset = time.Unix(0, times[0]).Add(opt.Period)
+	if !res.allowed {
+		res.retryAfter = res.reset.Sub(now)
+	}
+
+	fields := make([]string, len(times))
+	for i := range times {
+		fields[i] = strconv.FormatInt(times[i], 10)
+	}
+	return res, c.Put(key, strings.Join(fields, ","), seconds(opt.Period))
+}
+
+// tokenBucket stores the number of tokens and the time it was last updated in the cache
+// as "<tokens>:<Unix nanoseconds>". Updates are atomic only within the process.
+func tokenBucket(c Cache, key string, now time.Time, opt RateLimitOptions) (*rateLimitResult, error) {
+	lock := rateLimitLocks.get(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rate := float64(opt.Limit) / float64(opt.Period) // Tokens per nanosecond.
+	tokens := float64(opt.Burst)
+	if val, ok := toString(c.Get(key)); ok {
+		var last int64
+		if _, err := fmt.Sscanf(val, "%g:%d", &tokens, &last); err == nil {
+			tokens = math.Min(float64(opt.Burst), tokens+float64(now.UnixNano()-last)*rate)
+		} else {
+			tokens = float64(opt.Burst)
+		}
+	}
+
+	res := &rateLimitResult{allowed: tokens >= 1}
+	if res.allowed {
+		tokens--
+	} else {
+		res.retryAfter = time.Duration((1 - tokens) / rate)
+	}
+	res.remaining = int64(tokens)
+	full := time.Duration((float64(opt.Burst) - tokens) / rate)
+	res.reset = now.Add(full)
+
+	val := strconv.FormatFloat(tokens, 'g', -1, 64) + ":" + strconv.FormatInt(now.UnixNano(), 10)
+	return res, c.Put(key, val, seconds(full))
+}
+
+// RateLimit is a middleware that limits the rate of requests with state stored
+// in the cache.Cache mapped by Cacher. It sets X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset headers, and responds to requests over the limit with
+// 429 and Retry-After header. Requests are let through if the cache fails.
+// An single variadic cache.RateLimitOptions struct can be optionally provided to configure.
+func RateLimit(options ...RateLimitOptions) macaron.Handler {
+	opt := prepareRateLimitOptions(options)
+	return func(ctx *macaron.Context, c Cache) {
+		key := opt.KeyPrefix + opt.KeyFunc(ctx)
+		now := opt.Clock.Now()
+
+		var (
+			res *rateLimitResult
+			err error
+		)
+		switch opt.Algorithm {
+		case SlidingWindowLog:
+			res, err = slidingWindowLog(c, key, now, opt)
+		case TokenBucket:
+			res, err = tokenBucket(c, key, now, opt)
+		default:
+			res, err = fixedWindow(c, key, now, opt)
+		}
+		if err != nil {
+			log.Printf("cache: error limiting rate of '%s': %v", key, err)
+			return
+		}
+
+		header := ctx.Resp.Header()
+		header.Set("X-RateLimit-Limit", strconv.FormatInt(opt.Limit, 10))
+		header.Set("X-RateLimit-Remaining", strconv.FormatInt(res.remaining, 10))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(seconds(res.reset.Sub(time.Unix(0, 0))), 10))
+		if !res.allowed {
+			header.Set("Retry-After", strconv.FormatInt(seconds(res.retryAfter), 10))
+			http.Error(ctx.Resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}
+	}
+}
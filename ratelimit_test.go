@@ -0,0 +1,188 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Increment(t *testing.T) {
+	Convey("Increment counters", t, func() {
+		for _, c := range []Cache{
+			NewMemoryCacher(),
+			NewShardedCacher(0),
+			NewFailoverCacher(DefaultFailoverTimeout, 0),
+			NewRetrier(NewMemoryCacher(), RetryPolicy{}),
+			NewCircuitBreaker(NewMemoryCacher(), BreakerOptions{}),
+		} {
+			So(c.StartAndGC(Options{AdapterConfig: "memory;memory", Interval: 60}), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, _ = Increment(c, "counter", 2, 60)
+				}()
+			}
+			wg.Wait()
+
+			n, err := Increment(c, "counter", -5, 60)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 15)
+
+			So(c.Put("string", "abc", 60), ShouldBeNil)
+			_, err = Increment(c, "string", 1, 60)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Refuse adapters that cannot count", t, func() {
+		// The embedding struct hides IncrBy of MemoryCacher.
+		c := struct{ Cache }{NewMemoryCacher()}
+		So(c.StartAndGC(Options{Interval: 60}), ShouldBeNil)
+		_, err := Increment(c, "counter", 1, 60)
+		So(err, ShouldEqual, ErrCounterUnsupported)
+		_, err = Increment(NewRetrier(c, RetryPolicy{}), "counter", 1, 60)
+		So(err, ShouldEqual, ErrCounterUnsupported)
+	})
+}
+
+func Test_KeyByIP(t *testing.T) {
+	Convey("Identify clients by IP address", t, func() {
+		newContext := func(remoteAddr string, header ...string) *macaron.Context {
+			req, err := http.NewRequest("GET", "/", nil)
+			So(err, ShouldBeNil)
+			req.RemoteAddr = remoteAddr
+			for i := 0; i+1 < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			return &macaron.Context{Req: macaron.Request{Request: req}}
+		}
+
+		Convey("Ignore proxy headers by default", func() {
+			So(KeyByIP(newContext("10.0.0.1:1234")), ShouldEqual, "10.0.0.1")
+			So(KeyByIP(newContext("10.0.0.1:1234", "X-Forwarded-For", "1.2.3.4")), ShouldEqual, "10.0.0.1")
+			So(KeyByIP(newContext("10.0.0.1:1234", "X-Real-IP", "1.2.3.4")), ShouldEqual, "10.0.0.1")
+			So(KeyByIP(newContext("[::1]:1234")), ShouldEqual, "::1")
+		})
+
+		Convey("Honor proxy headers of trusted proxies only", func() {
+			key := KeyByProxiedIP("10.0.0.0/8", "192.168.1.1", "invalid")
+			So(key(newContext("10.0.0.1:1234", "X-Forwarded-For", "1.2.3.4")), ShouldEqual, "1.2.3.4")
+			So(key(newContext("192.168.1.1:1234", "X-Real-IP", "1.2.3.4")), ShouldEqual, "1.2.3.4")
+			So(key(newContext("192.168.1.2:1234", "X-Forwarded-For", "1.2.3.4")), ShouldEqual, "192.168.1.2")
+			So(key(newContext("10.0.0.1:1234")), ShouldEqual, "10.0.0.1")
+
+			// A client cannot hide behind addresses it puts in front of its own.
+			So(key(newContext("10.0.0.1:1234", "X-Forwarded-For", "5.6.7.8, 1.2.3.4, 10.0.0.2")), ShouldEqual, "1.2.3.4")
+			So(key(newContext("10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2")), ShouldEqual, "10.0.0.3")
+		})
+	})
+}
+
+func Test_RateLimit(t *testing.T) {
+	Convey("Limit rate of requests", t, func() {
+		clock := NewFakeClock(time.Unix(1e9, 0))
+		newServer := func(opt RateLimitOptions) func(ip string) *httptest.ResponseRecorder {
+			m := macaron.New()
+			m.Use(Cacher(Options{Adapter: "memory", Interval: 60, Clock: clock}))
+			m.Use(RateLimit(opt))
+			m.Get("/", func() string { return "ok" })
+			return func(ip string) *httptest.ResponseRecorder {
+				resp := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "/", nil)
+				So(err, ShouldBeNil)
+				req.RemoteAddr = ip + ":1234"
+				m.ServeHTTP(resp, req)
+				return resp
+			}
+		}
+		So(adapters["memory"].Flush(), ShouldBeNil)
+
+		Convey("Fixed window", func() {
+			serve := newServer(RateLimitOptions{Limit: 2, Period: 10 * time.Second, Clock: clock})
+
+			resp := serve("10.0.0.1")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(resp.Header().Get("X-RateLimit-Limit"), ShouldEqual, "2")
+			So(resp.Header().Get("X-RateLimit-Remaining"), ShouldEqual, "1")
+			So(resp.Header().Get("X-RateLimit-Reset"), ShouldEqual, "1000000010")
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+
+			resp = serve("10.0.0.1")
+			So(resp.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(resp.Header().Get("X-RateLimit-Remaining"), ShouldEqual, "0")
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "10")
+			So(serve("10.0.0.2").Code, ShouldEqual, http.StatusOK)
+
+			clock.Advance(10 * time.Second)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Sliding window log", func() {
+			serve := newServer(RateLimitOptions{
+				Algorithm: SlidingWindowLog,
+				Limit:     2,
+				Period:    10 * time.Second,
+				Clock:     clock,
+			})
+
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			clock.Advance(5 * time.Second)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			resp := serve("10.0.0.1")
+			So(resp.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "5")
+
+			clock.Advance(5 * time.Second)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusTooManyRequests)
+		})
+
+		Convey("Token bucket", func() {
+			serve := newServer(RateLimitOptions{
+				Algorithm: TokenBucket,
+				Limit:     1,
+				Period:    time.Second,
+				Burst:     3,
+				Clock:     clock,
+			})
+
+			for i := 0; i < 3; i++ {
+				So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			}
+			resp := serve("10.0.0.1")
+			So(resp.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(resp.Header().Get("Retry-After"), ShouldEqual, "1")
+
+			clock.Advance(time.Second)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			So(serve("10.0.0.1").Code, ShouldEqual, http.StatusTooManyRequests)
+
+			clock.Advance(time.Minute)
+			resp = serve("10.0.0.1")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(resp.Header().Get("X-RateLimit-Remaining"), ShouldEqual, "2")
+		})
+	})
+}
@@ -27,12 +27,57 @@ import (
 	"github.com/go-macaron/cache"
 )
 
+const (
+	// incrExistScript adds to an existing counter only, so that
+	// it cannot be recreated without expire time between the check and the update.
+	incrExistScript = `if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('not exist')
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])`
+	// incrByScript adds to a counter and sets expire time if it has just been created.
+	incrByScript = `local created = redis.call('EXISTS', KEYS[1]) == 0
+local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return v`
+	// lockScript sets the lock in the db of locks if it is not held and increases
+	// its fencing token, which expires with the lock. A missing token starts from
+	// the time in microseconds given by the client, so that tokens keep increasing
+	// after they have expired or been flushed.
+	lockScript = `redis.call('SELECT', ARGV[3])
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+if token < tonumber(ARGV[4]) then
+	redis.call('SET', KEYS[2], ARGV[4])
+	token = tonumber(ARGV[4])
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return token`
+	// unlockScript deletes the lock only if it is still held by the owner.
+	unlockScript = `redis.call('SELECT', ARGV[2])
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+	// refreshScript extends the lock and its fencing token only if it is still held by the owner.
+	refreshScript = `redis.call('SELECT', ARGV[3])
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[2], ARGV[2])
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+)
+
 // RedisCacher represents a redis cache adapter implementation.
 type RedisCacher struct {
 	c          *redis.Client
 	prefix     string
 	hsetName   string
 	occupyMode bool
+	lockDB     string // Index of the db that keeps locks and their fencing tokens.
 }
 
 // Put puts value into cache with key and expire time.
@@ -81,20 +126,92 @@ func (c *RedisCacher) Delete(key string) error {
 	return c.c.HDel(c.hsetName, key).Err()
 }
 
-// Incr increases cached int-type value by given key as a counter.
-func (c *RedisCacher) Incr(key string) error {
-	if !c.IsExist(key) {
+func (c *RedisCacher) incrExist(key string, delta int64) error {
+	err := c.c.Eval(incrExistScript, []string{c.prefix + key}, []string{com.ToStr(delta)}).Err()
+	if err != nil && err.Error() == "not exist" {
+		if !c.occupyMode {
+			c.c.HDel(c.hsetName, c.prefix+key)
+		}
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	return c.c.Incr(c.prefix + key).Err()
+	return err
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *RedisCacher) Incr(key string) error {
+	return c.incrExist(key, 1)
 }
 
 // Decr decreases cached int-type value by given key as a counter.
 func (c *RedisCacher) Decr(key string) error {
-	if !c.IsExist(key) {
-		return fmt.Errorf("key '%s' not exist", key)
+	return c.incrExist(key, -1)
+}
+
+// IncrBy adds delta to cached int-type value by given key and returns the result.
+// A missing or expired key is created with value delta and given expire time.
+func (c *RedisCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	key = c.prefix + key
+	n, err := c.evalInt(incrByScript, []string{key}, []string{com.ToStr(delta), com.ToStr(expire)})
+	if err != nil {
+		return 0, err
+	}
+
+	if c.occupyMode {
+		return n, nil
+	}
+	return n, c.c.HSet(c.hsetName, key, "0").Err()
+}
+
+func milliseconds(d time.Duration) string {
+	return com.ToStr(int64(d / time.Millisecond))
+}
+
+// evalInt runs script and returns its integer reply.
+func (c *RedisCacher) evalInt(script string, keys, args []string) (int64, error) {
+	val, err := c.c.Eval(script, keys, args).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := val.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply type %T", val)
 	}
-	return c.c.Decr(c.prefix + key).Err()
+	return n, nil
+}
+
+// Lock acquires the lock of given key that expires after ttl,
+// it returns cache.ErrLockHeld if the lock is held by another owner.
+func (c *RedisCacher) Lock(key string, ttl time.Duration) (cache.Lock, error) {
+	owner, err := cache.NewLockOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{c.prefix + cache.LockPrefix + key, c.prefix + cache.LockPrefix + key + cache.FenceSuffix}
+	now := com.ToStr(time.Now().UnixNano() / int64(time.Microsecond))
+	token, err := c.evalInt(lockScript, keys, []string{owner, milliseconds(ttl), c.lockDB, now})
+	if err != nil {
+		return nil, err
+	} else if token == 0 {
+		return nil, cache.ErrLockHeld
+	}
+
+	return cache.NewLock(token, func() error {
+		return c.evalLock(unlockScript, keys[:1], owner, c.lockDB)
+	}, func(ttl time.Duration) error {
+		return c.evalLock(refreshScript, keys, owner, milliseconds(ttl), c.lockDB)
+	}), nil
+}
+
+// evalLock runs script on the lock held by the owner.
+func (c *RedisCacher) evalLock(script string, keys []string, args ...string) error {
+	n, err := c.evalInt(script, keys, args)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return cache.ErrLockLost
+	}
+	return nil
 }
 
 // IsExist returns true if cached value exists.
@@ -109,7 +226,79 @@ func (c *RedisCacher) IsExist(key string) bool {
 	return false
 }
 
-// Flush deletes all cached data.
+// Inspect describes cached value by given key, it returns false if the value does not exist.
+func (c *RedisCacher) Inspect(key string) (cache.Entry, bool) {
+	size, err := c.c.StrLen(c.prefix + key).Result()
+	if err != nil {
+		return cache.Entry{}, false
+	}
+	// PTTL replies -2 if the key does not exist and -1 if it has no expire time.
+	ttl, err := c.c.PTTL(c.prefix + key).Result()
+	if err != nil || ttl == -2*time.Millisecond {
+		return cache.Entry{}, false
+	}
+
+	e := cache.Entry{Key: key, Size: size}
+	if ttl >= 0 {
+		e.Expires = time.Now().Add(ttl)
+	}
+	return e, true
+}
+
+// keys returns all cached keys with prefix.
+func (c *RedisCacher) keys() ([]string, error) {
+	if !c.occupyMode {
+		return c.c.HKeys(c.hsetName).Result()
+	}
+
+	var (
+		keys   []string
+		cursor int64
+	)
+	for {
+		next, page, err := c.c.Scan(cursor, c.prefix+"*", 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// Scan calls fn with every cached value in no particular order until fn returns false.
+func (c *RedisCacher) Scan(fn func(cache.Entry) bool) error {
+	keys, err := c.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, c.prefix) {
+			continue
+		}
+		e, ok := c.Inspect(strings.TrimPrefix(key, c.prefix))
+		if ok && !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stats returns number of keys in the cache.
+func (c *RedisCacher) Stats() map[string]int64 {
+	var n int64
+	if c.occupyMode {
+		n = c.c.DbSize().Val()
+	} else {
+		n = c.c.HLen(c.hsetName).Val()
+	}
+	return map[string]int64{"keys": n}
+}
+
+// Flush deletes all cached data. In occupy mode, the whole db is flushed,
+// including locks unless they are kept in another db.
 func (c *RedisCacher) Flush() error {
 	if c.occupyMode {
 		return c.c.FlushDb().Err()
@@ -125,11 +314,31 @@ func (c *RedisCacher) Flush() error {
 	return c.c.Del(c.hsetName).Err()
 }
 
+// Ping returns an error if the redis server cannot be reached.
+func (c *RedisCacher) Ping() error {
+	return c.c.Ping().Err()
+}
+
+// IsRetryable returns true if the operation failed with given error may succeed on retry.
+func (c *RedisCacher) IsRetryable(err error) bool {
+	if cache.IsTransientError(err) {
+		return true
+	} else if err == nil || err == redis.Nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "LOADING ") ||
+		strings.HasPrefix(msg, "TRYAGAIN ") ||
+		strings.HasPrefix(msg, "BUSY ")
+}
+
 // StartAndGC starts GC routine based on config string settings.
-// AdapterConfig: network=tcp,addr=:6379,password=macaron,db=0,pool_size=100,idle_timeout=180,hset_name=MacaronCache,prefix=cache:
+// AdapterConfig: network=tcp,addr=:6379,password=macaron,db=0,lock_db=1,pool_size=100,idle_timeout=180,hset_name=MacaronCache,prefix=cache:
+// Locks are kept in lock_db, which defaults to db.
 func (c *RedisCacher) StartAndGC(opts cache.Options) error {
 	c.hsetName = "MacaronCache"
 	c.occupyMode = opts.OccupyMode
+	c.lockDB = ""
 
 	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
 	if err != nil {
@@ -149,6 +358,8 @@ func (c *RedisCacher) StartAndGC(opts cache.Options) error {
 			opt.Password = v
 		case "db":
 			opt.DB = com.StrTo(v).MustInt64()
+		case "lock_db":
+			c.lockDB = com.ToStr(com.StrTo(v).MustInt64())
 		case "pool_size":
 			opt.PoolSize = com.StrTo(v).MustInt()
 		case "idle_timeout":
@@ -165,6 +376,10 @@ func (c *RedisCacher) StartAndGC(opts cache.Options) error {
 		}
 	}
 
+	if len(c.lockDB) == 0 {
+		c.lockDB = com.ToStr(opt.DB)
+	}
+
 	c.c = redis.NewClient(opt)
 	if err = c.c.Ping().Err(); err != nil {
 		return err
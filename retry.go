@@ -0,0 +1,218 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryClassifier is implemented by adapters that can tell which of
+// their errors are transient and worth retrying.
+type RetryClassifier interface {
+	// IsRetryable returns true if the operation failed with given error may succeed on retry.
+	IsRetryable(err error) bool
+}
+
+// UnappliedClassifier is implemented by adapters that can tell which of their
+// errors guarantee the operation had no effect, so that even counters can be retried.
+type UnappliedClassifier interface {
+	// IsUnapplied returns true if the operation failed with given error had no effect.
+	IsUnapplied(err error) bool
+}
+
+// IsUnappliedError returns true if given error is known to be returned before
+// the operation was sent, such as driver.ErrBadConn of database/sql drivers.
+func IsUnappliedError(err error) bool {
+	return err == driver.ErrBadConn
+}
+
+// IsTransientError returns true if given error is a network error
+// that is likely to go away on retry.
+func IsTransientError(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *net.OpError:
+		return true
+	case net.Error:
+		return err.Timeout()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// RetryPolicy represents a struct for specifying how failed operations are retried.
+type RetryPolicy struct {
+	// Maximum number of attempts including the first one. Default is 3.
+	MaxAttempts int
+	// Delay before the first retry, doubled for every next one. Default is 50 milliseconds.
+	BaseDelay time.Duration
+	// Upper bound of delay between attempts. Default is 1 second.
+	MaxDelay time.Duration
+	// Whether Incr, Decr and IncrBy are retried on any retryable error. They are not
+	// idempotent, so a retry after an error that happened once the command was
+	// sent may count twice. Otherwise they are only retried on errors reported
+	// by IsUnapplied. Default is false.
+	RetryCounters bool
+	// IsRetryable reports whether an error is worth retrying. Default uses the
+	// adapter's RetryClassifier if it implements one, and IsTransientError otherwise.
+	IsRetryable func(error) bool
+	// IsUnapplied reports whether an error guarantees the operation had no effect,
+	// so that counters can be retried. Default uses the adapter's UnappliedClassifier
+	// if it implements one, and IsUnappliedError otherwise.
+	IsUnapplied func(error) bool
+}
+
+func prepareRetryPolicy(c Cache, p RetryPolicy) RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 50 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = time.Second
+	}
+	if p.IsRetryable == nil {
+		if rc, ok := c.(RetryClassifier); ok {
+			p.IsRetryable = rc.IsRetryable
+		} else {
+			p.IsRetryable = IsTransientError
+		}
+	}
+	if p.IsUnapplied == nil {
+		if uc, ok := c.(UnappliedClassifier); ok {
+			p.IsUnapplied = uc.IsUnapplied
+		} else {
+			p.IsUnapplied = IsUnappliedError
+		}
+	}
+	return p
+}
+
+// backoff returns delay before given retry with full jitter.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay << uint(retry)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Retrier is a cache wrapper that retries operations failed with transient errors.
+// Get and IsExist do not report errors and are therefore never retried.
+type Retrier struct {
+	c      Cache
+	policy RetryPolicy
+}
+
+// NewRetrier wraps given cache with a retry policy.
+func NewRetrier(c Cache, p RetryPolicy) *Retrier {
+	return &Retrier{
+		c:      c,
+		policy: prepareRetryPolicy(c, p),
+	}
+}
+
+func (r *Retrier) do(fn func() error) error {
+	return r.retry(fn, r.policy.IsRetryable)
+}
+
+// counter retries counter updates only on errors that are safe for them.
+func (r *Retrier) counter(fn func() error) error {
+	if r.policy.RetryCounters {
+		return r.retry(fn, r.policy.IsRetryable)
+	}
+	return r.retry(fn, r.policy.IsUnapplied)
+}
+
+func (r *Retrier) retry(fn func() error, retryable func(error) bool) (err error) {
+	for i := 0; i < r.policy.MaxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(r.policy.backoff(i - 1))
+		}
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Put puts value into cache with key and expire time.
+func (r *Retrier) Put(key string, val interface{}, expire int64) error {
+	return r.do(func() error {
+		return r.c.Put(key, val, expire)
+	})
+}
+
+// Get gets cached value by given key.
+func (r *Retrier) Get(key string) interface{} {
+	return r.c.Get(key)
+}
+
+// Delete deletes cached value by given key.
+func (r *Retrier) Delete(key string) error {
+	return r.do(func() error {
+		return r.c.Delete(key)
+	})
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (r *Retrier) Incr(key string) error {
+	return r.counter(func() error {
+		return r.c.Incr(key)
+	})
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (r *Retrier) Decr(key string) error {
+	return r.counter(func() error {
+		return r.c.Decr(key)
+	})
+}
+
+// IncrBy adds delta to the counter of given key, it returns ErrCounterUnsupported
+// if the wrapped adapter does not implement Counter.
+func (r *Retrier) IncrBy(key string, delta, expire int64) (n int64, err error) {
+	counter, ok := r.c.(Counter)
+	if !ok {
+		return 0, ErrCounterUnsupported
+	}
+	err = r.counter(func() (err error) {
+		n, err = counter.IncrBy(key, delta, expire)
+		return err
+	})
+	return n, err
+}
+
+// IsExist returns true if cached value exists.
+func (r *Retrier) IsExist(key string) bool {
+	return r.c.IsExist(key)
+}
+
+// Flush deletes all cached data.
+func (r *Retrier) Flush() error {
+	return r.do(func() error {
+		return r.c.Flush()
+	})
+}
+
+// StartAndGC starts the wrapped adapter.
+func (r *Retrier) StartAndGC(opt Options) error {
+	return r.c.StartAndGC(opt)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failingCacher fails the first given number of calls with given error.
+type failingCacher struct {
+	*MemoryCacher
+	failures int
+	err      error
+	calls    int
+}
+
+func (c *failingCacher) fail() error {
+	c.calls++
+	if c.calls <= c.failures {
+		return c.err
+	}
+	return nil
+}
+
+func (c *failingCacher) Put(key string, val interface{}, expire int64) error {
+	if err := c.fail(); err != nil {
+		return err
+	}
+	return c.MemoryCacher.Put(key, val, expire)
+}
+
+func (c *failingCacher) Incr(key string) error {
+	if err := c.fail(); err != nil {
+		return err
+	}
+	return c.MemoryCacher.Incr(key)
+}
+
+func Test_Retrier(t *testing.T) {
+	Convey("Classify transient errors", t, func() {
+		So(IsTransientError(nil), ShouldBeFalse)
+		So(IsTransientError(io.EOF), ShouldBeTrue)
+		So(IsTransientError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), ShouldBeTrue)
+		So(IsTransientError(errors.New("key not exist")), ShouldBeFalse)
+		So(IsUnappliedError(driver.ErrBadConn), ShouldBeTrue)
+		So(IsUnappliedError(io.EOF), ShouldBeFalse)
+	})
+
+	Convey("Test retry policy", t, func() {
+		c := &failingCacher{MemoryCacher: NewMemoryCacher(), err: io.EOF}
+		r := NewRetrier(c, RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+		})
+
+		Convey("Retry transient errors", func() {
+			c.failures = 2
+			So(r.Put("uname", "unknwon", 0), ShouldBeNil)
+			So(c.calls, ShouldEqual, 3)
+			So(r.Get("uname"), ShouldEqual, "unknwon")
+		})
+
+		Convey("Give up after max attempts", func() {
+			c.failures = 3
+			So(r.Put("uname", "unknwon", 0), ShouldEqual, io.EOF)
+			So(c.calls, ShouldEqual, 3)
+		})
+
+		Convey("Do not retry permanent errors", func() {
+			c.failures = 1
+			c.err = errors.New("permanent")
+			So(r.Put("uname", "unknwon", 0), ShouldNotBeNil)
+			So(c.calls, ShouldEqual, 1)
+		})
+
+		Convey("Do not retry counters by default", func() {
+			So(c.MemoryCacher.Put("int", 0, 0), ShouldBeNil)
+			c.failures = 1
+			So(r.Incr("int"), ShouldEqual, io.EOF)
+			So(c.calls, ShouldEqual, 1)
+
+			r = NewRetrier(c, RetryPolicy{RetryCounters: true, BaseDelay: time.Millisecond})
+			c.calls = 0
+			So(r.Incr("int"), ShouldBeNil)
+			So(c.calls, ShouldEqual, 2)
+			So(r.Get("int"), ShouldEqual, 1)
+		})
+
+		Convey("Retry counters on errors that had no effect", func() {
+			So(c.MemoryCacher.Put("int", 0, 0), ShouldBeNil)
+			c.failures = 1
+			c.err = driver.ErrBadConn
+			So(r.Incr("int"), ShouldBeNil)
+			So(c.calls, ShouldEqual, 2)
+			So(r.Get("int"), ShouldEqual, 1)
+		})
+	})
+}
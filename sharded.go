@@ -0,0 +1,381 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVirtualNodes is the number of points each shard owns on the hash ring.
+const DefaultVirtualNodes = 160
+
+// hashRing is a consistent-hash ring with virtual nodes. A point claimed by
+// several shards belongs to the smallest name, so that the ring only depends
+// on the set of shards and not on the order they were added in.
+type hashRing struct {
+	vnodes int
+	names  []string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes < 1 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &hashRing{
+		vnodes: vnodes,
+		owners: make(map[uint32]string),
+	}
+}
+
+func (r *hashRing) add(name string) {
+	r.names = append(r.names, name)
+	r.claim(name)
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// claim adds the points of given shard to the ring.
+func (r *hashRing) claim(name string) {
+	for i := 0; i < r.vnodes; i++ {
+		h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+		if owner, ok := r.owners[h]; !ok {
+			r.hashes = append(r.hashes, h)
+		} else if owner < name {
+			continue
+		}
+		r.owners[h] = name
+	}
+}
+
+// remove takes the points of given shard off the ring. Points it shared
+// with other shards are given back to them, so the ring is rebuilt.
+func (r *hashRing) remove(name string) {
+	names := r.names[:0]
+	for _, n := range r.names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+
+	r.names = names
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string)
+	for _, n := range r.names {
+		r.claim(n)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// get returns the name of the shard that owns given key.
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// ShardedCacher represents a cache adapter that distributes keys
+// across multiple child cachers using a consistent-hash ring.
+type ShardedCacher struct {
+	lock   sync.RWMutex
+	ring   *hashRing
+	shards map[string]Cache
+}
+
+// NewShardedCacher creates and returns a new sharded cacher
+// with given number of virtual nodes per shard.
+func NewShardedCacher(vnodes int) *ShardedCacher {
+	return &ShardedCacher{
+		ring:   newHashRing(vnodes),
+		shards: make(map[string]Cache),
+	}
+}
+
+// AddShard adds a started cacher to the ring under given name.
+func (c *ShardedCacher) AddShard(name string, shard Cache) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.shards == nil {
+		c.ring = newHashRing(DefaultVirtualNodes)
+		c.shards = make(map[string]Cache)
+	}
+	if _, ok := c.shards[name]; ok {
+		return fmt.Errorf("cache/sharded: shard '%s' already exists", name)
+	}
+	c.shards[name] = shard
+	c.ring.add(name)
+	return nil
+}
+
+// RemoveShard removes the shard with given name from the ring.
+func (c *ShardedCacher) RemoveShard(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.shards[name]; !ok {
+		return
+	}
+	delete(c.shards, name)
+	c.ring.remove(name)
+}
+
+func (c *ShardedCacher) shard(key string) (Cache, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.ring == nil {
+		return nil, errors.New("cache/sharded: no shards available")
+	}
+	shard, ok := c.shards[c.ring.get(key)]
+	if !ok {
+		return nil, errors.New("cache/sharded: no shards available")
+	}
+	return shard, nil
+}
+
+// Put puts value into cache with key and expire time.
+func (c *ShardedCacher) Put(key string, val interface{}, expire int64) error {
+	shard, err := c.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Put(key, val, expire)
+}
+
+// Get gets cached value by given key.
+func (c *ShardedCacher) Get(key string) interface{} {
+	shard, err := c.shard(key)
+	if err != nil {
+		return nil
+	}
+	return shard.Get(key)
+}
+
+// Delete deletes cached value by given key.
+func (c *ShardedCacher) Delete(key string) error {
+	shard, err := c.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Delete(key)
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *ShardedCacher) Incr(key string) error {
+	shard, err := c.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Incr(key)
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (c *ShardedCacher) Decr(key string) error {
+	shard, err := c.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Decr(key)
+}
+
+// Lock acquires the lock of given key in the shard owning the key,
+// it returns ErrLockUnsupported if the shard does not implement Locker.
+func (c *ShardedCacher) Lock(key string, ttl time.Duration) (Lock, error) {
+	shard, err := c.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	locker, ok := shard.(Locker)
+	if !ok {
+		return nil, ErrLockUnsupported
+	}
+	return locker.Lock(key, ttl)
+}
+
+// IncrBy adds delta to the counter of given key in the shard owning the key,
+// it returns ErrCounterUnsupported if the shard does not implement Counter.
+func (c *ShardedCacher) IncrBy(key string, delta, expire int64) (int64, error) {
+	shard, err := c.shard(key)
+	if err != nil {
+		return 0, err
+	}
+	counter, ok := shard.(Counter)
+	if !ok {
+		return 0, ErrCounterUnsupported
+	}
+	return counter.IncrBy(key, delta, expire)
+}
+
+// IsExist returns true if cached value exists.
+func (c *ShardedCacher) IsExist(key string) bool {
+	shard, err := c.shard(key)
+	if err != nil {
+		return false
+	}
+	return shard.IsExist(key)
+}
+
+// Inspect describes cached value by given key in the shard owning the key,
+// it returns false if the shard does not implement Scanner.
+func (c *ShardedCacher) Inspect(key string) (Entry, bool) {
+	shard, err := c.shard(key)
+	if err != nil {
+		return Entry{}, false
+	}
+	scanner, ok := shard.(Scanner)
+	if !ok {
+		return Entry{}, false
+	}
+	return scanner.Inspect(key)
+}
+
+// Scan calls fn with every cached value of every shard in no particular order
+// until fn returns false. Values left in a shard that no longer owns their key
+// are skipped, as they cannot be read. It returns ErrScanUnsupported if any
+// shard does not implement Scanner.
+func (c *ShardedCacher) Scan(fn func(Entry) bool) error {
+	c.lock.RLock()
+	scanners := make(map[string]Scanner, len(c.shards))
+	for name, shard := range c.shards {
+		scanner, ok := shard.(Scanner)
+		if !ok {
+			c.lock.RUnlock()
+			return ErrScanUnsupported
+		}
+		scanners[name] = scanner
+	}
+	c.lock.RUnlock()
+
+	stop := false
+	for name, scanner := range scanners {
+		err := scanner.Scan(func(e Entry) bool {
+			c.lock.RLock()
+			owner := c.ring.get(e.Key)
+			c.lock.RUnlock()
+			if owner != name {
+				return true
+			}
+			stop = !fn(e)
+			return !stop
+		})
+		if err != nil {
+			return fmt.Errorf("cache/sharded: error scanning shard '%s': %v", name, err)
+		} else if stop {
+			break
+		}
+	}
+	return nil
+}
+
+// Stats returns statistics of every shard implementing StatsReporter,
+// values of the same name are summed.
+func (c *ShardedCacher) Stats() map[string]int64 {
+	c.lock.RLock()
+	shards := make([]Cache, 0, len(c.shards))
+	for _, shard := range c.shards {
+		shards = append(shards, shard)
+	}
+	c.lock.RUnlock()
+
+	stats := make(map[string]int64)
+	for _, shard := range shards {
+		reporter, ok := shard.(StatsReporter)
+		if !ok {
+			continue
+		}
+		for name, n := range reporter.Stats() {
+			stats[name] += n
+		}
+	}
+	return stats
+}
+
+// Flush deletes all cached data of every shard.
+func (c *ShardedCacher) Flush() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for name, shard := range c.shards {
+		if err := shard.Flush(); err != nil {
+			return fmt.Errorf("cache/sharded: error flushing shard '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// StartAndGC starts every shard based on config string settings.
+// Shards are separated by semicolons, each one in form of "<adapter>:<adapter config>".
+// The position of a shard in the list is used as its identity on the ring,
+// so shards should only be appended to keep keys where they are.
+// AdapterConfig: redis:addr=:6379,prefix=cache:;redis:addr=:6380,prefix=cache:
+func (c *ShardedCacher) StartAndGC(opt Options) error {
+	var defs []string
+	for _, def := range strings.Split(opt.AdapterConfig, ";") {
+		if def = strings.TrimSpace(def); len(def) > 0 {
+			defs = append(defs, def)
+		}
+	}
+	if len(defs) == 0 {
+		return errors.New("cache/sharded: no shards configured")
+	}
+
+	ring := newHashRing(DefaultVirtualNodes)
+	shards := make(map[string]Cache, len(defs))
+	for i, def := range defs {
+		shard, shardOpt, err := childAdapter(def, opt)
+		if err == nil && shardOpt.Adapter == "sharded" {
+			err = errors.New("cache/sharded: shard cannot be another sharded adapter")
+		} else if err == nil {
+			if err = shard.StartAndGC(shardOpt); err != nil {
+				err = fmt.Errorf("cache/sharded: error starting shard '%s': %v", def, err)
+			}
+		}
+		if err != nil {
+			// Shards already started would otherwise keep running their GC.
+			for _, shard := range shards {
+				stopAdapter(shard)
+			}
+			return err
+		}
+
+		name := strconv.Itoa(i)
+		shards[name] = shard
+		ring.add(name)
+	}
+
+	c.lock.Lock()
+	c.ring = ring
+	c.shards = shards
+	c.lock.Unlock()
+	return nil
+}
+
+func init() {
+	Register("sharded", NewShardedCacher(DefaultVirtualNodes))
+}
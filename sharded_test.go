@@ -0,0 +1,164 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// closingCacher counts instances closed by composite adapters.
+type closingCacher struct {
+	NullCacher
+}
+
+var closedCachers int32
+
+func (c *closingCacher) Close() error {
+	atomic.AddInt32(&closedCachers, 1)
+	return nil
+}
+
+func init() {
+	Register("closing", &closingCacher{})
+}
+
+func Test_ShardedCacher(t *testing.T) {
+	Convey("Test sharded cache adapter", t, func() {
+		dir := path.Join(os.TempDir(), "data/sharded")
+		os.RemoveAll(dir)
+		testAdapter(Options{
+			Adapter:       "sharded",
+			AdapterConfig: "file:" + path.Join(dir, "1") + ";file:" + path.Join(dir, "2") + ";memory",
+			Interval:      2,
+		})
+	})
+
+	Convey("Reject invalid shard configurations", t, func() {
+		c := NewShardedCacher(DefaultVirtualNodes)
+		So(c.StartAndGC(Options{AdapterConfig: ""}), ShouldNotBeNil)
+		So(c.StartAndGC(Options{AdapterConfig: "fake:"}), ShouldNotBeNil)
+		So(c.StartAndGC(Options{AdapterConfig: "memory;sharded:memory"}), ShouldNotBeNil)
+	})
+
+	Convey("Identify shards by their position", t, func() {
+		c := NewShardedCacher(DefaultVirtualNodes)
+		So(c.StartAndGC(Options{AdapterConfig: "memory;memory", Interval: 60}), ShouldBeNil)
+		So(c.shards, ShouldHaveLength, 2)
+		for i := 0; i < 100; i++ {
+			So(c.Put("key"+strconv.Itoa(i), i, 0), ShouldBeNil)
+		}
+		for _, shard := range c.shards {
+			So(shard.(*MemoryCacher).Stats()["items"], ShouldBeGreaterThan, 0)
+		}
+	})
+
+	Convey("Scan and report statistics of every shard", t, func() {
+		c := NewShardedCacher(DefaultVirtualNodes)
+		So(c.StartAndGC(Options{AdapterConfig: "memory;memory", Interval: 60}), ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			So(c.Put("key"+strconv.Itoa(i), i, 0), ShouldBeNil)
+		}
+		So(c.Stats()["items"], ShouldEqual, 100)
+
+		e, ok := c.Inspect("key1")
+		So(ok, ShouldBeTrue)
+		So(e.Key, ShouldEqual, "key1")
+
+		keys := make(map[string]bool)
+		So(c.Scan(func(e Entry) bool {
+			keys[e.Key] = true
+			return true
+		}), ShouldBeNil)
+		So(keys, ShouldHaveLength, 100)
+
+		n := 0
+		So(c.Scan(func(Entry) bool {
+			n++
+			return n < 10
+		}), ShouldBeNil)
+		So(n, ShouldEqual, 10)
+
+		// Keys moved to a new shard are not reachable anymore.
+		shard := NewMemoryCacher()
+		So(shard.StartAndGC(Options{Interval: 60}), ShouldBeNil)
+		So(c.AddShard("2", shard), ShouldBeNil)
+		keys = make(map[string]bool)
+		So(c.Scan(func(e Entry) bool {
+			keys[e.Key] = true
+			return true
+		}), ShouldBeNil)
+		So(len(keys), ShouldBeLessThan, 100)
+		for key := range keys {
+			So(c.Get(key), ShouldNotBeNil)
+		}
+
+		So(c.AddShard("null", NewNullCacher(false)), ShouldBeNil)
+		So(c.Scan(func(Entry) bool { return true }), ShouldEqual, ErrScanUnsupported)
+	})
+
+	Convey("Stop started shards when another one fails", t, func() {
+		c := NewShardedCacher(DefaultVirtualNodes)
+		atomic.StoreInt32(&closedCachers, 0)
+		So(c.StartAndGC(Options{AdapterConfig: "closing;closing;fake:"}), ShouldNotBeNil)
+		So(atomic.LoadInt32(&closedCachers), ShouldEqual, 2)
+	})
+
+	Convey("Adding a shard moves only a small share of keys", t, func() {
+		ring := newHashRing(DefaultVirtualNodes)
+		for i := 0; i < 4; i++ {
+			ring.add("shard" + strconv.Itoa(i))
+		}
+
+		const total = 10000
+		before := make([]string, total)
+		for i := range before {
+			before[i] = ring.get("key" + strconv.Itoa(i))
+		}
+
+		ring.add("shard4")
+		moved := 0
+		for i := range before {
+			owner := ring.get("key" + strconv.Itoa(i))
+			if owner != before[i] {
+				So(owner, ShouldEqual, "shard4")
+				moved++
+			}
+		}
+		So(moved, ShouldBeGreaterThan, 0)
+		So(moved, ShouldBeLessThan, total*2/5)
+
+		ring.remove("shard4")
+		for i := range before {
+			So(ring.get("key"+strconv.Itoa(i)), ShouldEqual, before[i])
+		}
+	})
+
+	Convey("Removing a shard gives shared points back", t, func() {
+		ring := newHashRing(1)
+		ring.add("b")
+		ring.owners[ring.hashes[0]] = "a"
+		ring.names = append(ring.names, "a")
+		// Both shards claimed the point, which goes back to the other one.
+		ring.remove("a")
+		So(ring.hashes, ShouldHaveLength, 1)
+		So(ring.get("key"), ShouldEqual, "b")
+	})
+}
@@ -18,6 +18,12 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 )
 
 func EncodeGob(item *Item) ([]byte, error) {
@@ -82,3 +88,116 @@ func Decr(val interface{}) (v interface{}, _ error) {
 	}
 	return v, nil
 }
+
+// IncrBy adds delta to cached int-type value, the result keeps the type of given value.
+func IncrBy(val interface{}, delta int64) (v interface{}, _ error) {
+	switch val := val.(type) {
+	case int:
+		v = val + int(delta)
+	case int32:
+		v = val + int32(delta)
+	case int64:
+		v = val + delta
+	case uint:
+		if delta < 0 && uint64(-delta) > uint64(val) {
+			return val, errors.New("item value is less than 0")
+		}
+		v = uint(int64(val) + delta)
+	case uint32:
+		if delta < 0 && uint64(-delta) > uint64(val) {
+			return val, errors.New("item value is less than 0")
+		}
+		v = uint32(int64(val) + delta)
+	case uint64:
+		if delta < 0 && uint64(-delta) > val {
+			return val, errors.New("item value is less than 0")
+		}
+		v = uint64(int64(val) + delta)
+	default:
+		return val, errors.New("item value is not int-type")
+	}
+	return v, nil
+}
+
+// ToInt64 converts cached int-type value or its string form to int64.
+func ToInt64(val interface{}) (int64, error) {
+	switch val := val.(type) {
+	case int:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case uint:
+		return int64(val), nil
+	case uint32:
+		return int64(val), nil
+	case uint64:
+		return int64(val), nil
+	case string:
+		return strconv.ParseInt(val, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(val), 10, 64)
+	}
+	return 0, errors.New("item value is not int-type")
+}
+
+// writeFileAtomic writes the file by given name through write, so that readers
+// see either its old or new content in full, even if the process crashes.
+// The content and the rename are also synced to disk if sync is true.
+func writeFileAtomic(name string, sync bool, write func(io.Writer) error) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := createTempFile(dir, filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = write(f); err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), name); err != nil || !sync {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// createTempFile creates a new file in given directory with name starting with prefix.
+// Unlike ioutil.TempFile, the file is created with os.ModePerm less umask,
+// the mode files of the cache had before they were written atomically.
+func createTempFile(dir, prefix string) (f *os.File, err error) {
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// syncDir syncs given directory to disk, so that entries renamed into it persist.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be synced on Windows.
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
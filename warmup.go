@@ -0,0 +1,126 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// WarmupSource opens a stream of values in the format written by Export
+// to warm up the cache with.
+type WarmupSource func() (io.ReadCloser, error)
+
+// WarmupFile returns a WarmupSource that reads given file.
+func WarmupFile(name string) WarmupSource {
+	return func() (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+}
+
+// WarmupProgress reports progress of warming up the cache.
+type WarmupProgress struct {
+	// Number of values put into the cache.
+	Loaded int
+	// Number of values skipped because they have expired since the export.
+	Expired int
+	// Number of values failed to be decoded or put into the cache.
+	Failed int
+	// True when all values have been processed.
+	Done bool
+}
+
+// warmupReportInterval is the number of processed values between progress reports.
+const warmupReportInterval = 1000
+
+func logWarmupProgress(p WarmupProgress) {
+	if p.Done {
+		log.Printf("cache: warmed up %d values, %d expired, %d failed", p.Loaded, p.Expired, p.Failed)
+	}
+}
+
+// warmup loads values from the warmup source into the cache with bounded concurrency.
+// Values that have expired since the export are skipped.
+func warmup(c Cache, opt Options) error {
+	rc, err := opt.WarmupSource()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	im, err := newImporter(rc)
+	if err != nil {
+		return err
+	}
+
+	var (
+		lock     sync.Mutex
+		progress WarmupProgress
+	)
+	report := func(loaded, expired, failed int) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		progress.Loaded += loaded
+		progress.Expired += expired
+		progress.Failed += failed
+		if (progress.Loaded+progress.Expired+progress.Failed)%warmupReportInterval == 0 {
+			opt.WarmupProgress(progress)
+		}
+	}
+
+	workers := opt.WarmupConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	records := make(chan *exportRecord)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range records {
+				expire, ok := im.expire(rec, true, opt.Clock.Now())
+				if !ok {
+					report(0, 1, 0)
+				} else if err := im.put(c, rec, expire); err != nil {
+					log.Printf("cache: error warming up: %v", err)
+					report(0, 0, 1)
+				} else {
+					report(1, 0, 0)
+				}
+			}
+		}()
+	}
+
+	for {
+		var rec *exportRecord
+		if rec, err = im.next(); err != nil {
+			break
+		}
+		records <- rec
+	}
+	close(records)
+	wg.Wait()
+
+	progress.Done = true
+	opt.WarmupProgress(progress)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Warmup(t *testing.T) {
+	Convey("Warm up cache from a seed", t, func() {
+		src := NewMemoryCacher()
+		So(src.StartAndGC(Options{}), ShouldBeNil)
+		for i := 0; i < 2500; i++ {
+			So(src.Put("warmup:"+strconv.Itoa(i), i, 0), ShouldBeNil)
+		}
+		var buf bytes.Buffer
+		_, err := Export(src, &buf)
+		So(err, ShouldBeNil)
+
+		// Move the export back in time and add a value that has expired since then.
+		seed := regexp.MustCompile(`"time":\d+`).ReplaceAllString(buf.String(), `"time":1`) +
+			`{"key":"warmup:expired","codec":"string","value":"","ttl":1}` + "\n"
+
+		So(adapters["memory"].Flush(), ShouldBeNil)
+		var reports []WarmupProgress
+		Cacher(Options{
+			Adapter: "memory",
+			WarmupSource: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(seed)), nil
+			},
+			WarmupConcurrency: 4,
+			WarmupProgress: func(p WarmupProgress) {
+				reports = append(reports, p)
+			},
+		})
+
+		c := adapters["memory"]
+		So(c.Get("warmup:0"), ShouldEqual, 0)
+		So(c.Get("warmup:2499"), ShouldEqual, 2499)
+		So(len(reports), ShouldEqual, 3)
+		So(reports[0].Loaded+reports[0].Expired, ShouldEqual, 1000)
+		So(reports[2], ShouldResemble, WarmupProgress{Loaded: 2500, Expired: 1, Done: true})
+		So(c.Get("warmup:expired"), ShouldBeNil)
+	})
+
+	Convey("Warm up from a file", t, func() {
+		name := path.Join(os.TempDir(), "warmup.json")
+		So(ioutil.WriteFile(name, []byte(`{"format":"macaron-cache","version":1,"time":1}
+{"key":"warmup:expired","codec":"string","value":"","ttl":1}
+{"key":"warmup:file","codec":"string","value":"dW5rbndvbg=="}
+{"key":"warmup:broken","codec":"xml","value":""}
+`), 0644), ShouldBeNil)
+		defer os.Remove(name)
+
+		var last WarmupProgress
+		So(warmup(adapters["memory"], Options{
+			WarmupSource:      WarmupFile(name),
+			WarmupConcurrency: 2,
+			WarmupProgress:    func(p WarmupProgress) { last = p },
+			Clock:             DefaultClock,
+		}), ShouldBeNil)
+		So(last, ShouldResemble, WarmupProgress{Loaded: 1, Expired: 1, Failed: 1, Done: true})
+		So(adapters["memory"].Get("warmup:file"), ShouldEqual, "unknwon")
+	})
+
+	Convey("Report errors of the source", t, func() {
+		opt := Options{
+			WarmupSource: func() (io.ReadCloser, error) {
+				return nil, errors.New("no seed")
+			},
+			WarmupProgress: logWarmupProgress,
+		}
+		So(warmup(adapters["memory"], opt), ShouldNotBeNil)
+
+		opt.WarmupSource = WarmupFile(path.Join(os.TempDir(), "404.json"))
+		So(warmup(adapters["memory"], opt), ShouldNotBeNil)
+	})
+}